@@ -2,20 +2,68 @@ package ai
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/krol22/invoice_go_sort_sort/log"
 	"github.com/krol22/invoice_go_sort_sort/utils"
 )
 
 type AnthropicClient struct {
-  baseUrl string
   apiKey string
+  config *Config
+  httpClient *http.Client
+  cache *Cache
+  ledger *UsageLedger
 }
 
+type ClientOption func(c *AnthropicClient)
+
+const TOOL_NAME = "data_extractor"
+
+// ValidationError is returned by RunLLM when the output is still invalid after
+// all the attempts, together with the last response.
+type ValidationError struct {
+  Attempts int
+  Output map[string]interface{}
+  PromptVersion string
+  Err error
+}
+
+func (e *ValidationError) Error() string {
+  return fmt.Sprintf("output still invalid after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+  return e.Err
+}
+
+// Anthropic's status code for an overloaded API.
+const STATUS_OVERLOADED = 529
+
+type APIError struct {
+  StatusCode int
+  Body string
+}
+
+func (e *APIError) Error() string {
+  return fmt.Sprintf("request failed with status code: %d\n%s", e.StatusCode, e.Body)
+}
+
+var (
+  ErrEmptyResponse = errors.New("response has no content")
+  ErrNoToolCall = errors.New("response has no " + TOOL_NAME + " tool call")
+  ErrTruncated = errors.New("response was truncated by max_tokens")
+)
+
 type anthropicResponse struct {
   Id string `json:"id"`
   Type string `json:"type"`
@@ -58,78 +106,324 @@ type inputSchemaProperty struct {
   Description string `json:"description"`
 }
 
-const MODEL = "claude-3-5-sonnet-20240620"
-
 var l = log.Get()
 
-func NewClient(apiKey string) *AnthropicClient {
-  return &AnthropicClient{
-    baseUrl: "https://api.anthropic.com",
+func NewClient(apiKey string, options ...ClientOption) *AnthropicClient {
+  c := &AnthropicClient{
     apiKey: apiKey,
+    config: DefaultConfig(),
+    httpClient: &http.Client{
+      Timeout: DEFAULT_TIMEOUT,
+    },
+  }
+
+  for _, option := range options {
+    option(c)
+  }
+
+  return c
+}
+
+// WithConfig sets the API endpoint and model settings. It also sets the
+// timeout of the http client, so pass it before WithHttpClient if you want to
+// keep the timeout of your own client.
+func WithConfig(config *Config) ClientOption {
+  return func(c *AnthropicClient) {
+    c.config = config
+
+    httpClient := *c.httpClient
+    httpClient.Timeout = config.Timeout
+    c.httpClient = &httpClient
   }
 }
 
-func (c *AnthropicClient) createRequest(method string, body map[string]interface{}) (*http.Request, error) {
-  jsonBody, err := json.Marshal(body)
+// WithBaseUrl points the client at a different API, e.g. a proxy or a fake
+// server in the tests. Pass it after WithConfig, which sets the base url too.
+func WithBaseUrl(baseUrl string) ClientOption {
+  return func(c *AnthropicClient) {
+    config := *c.config
+    config.BaseUrl = strings.TrimSuffix(baseUrl, "/")
+    c.config = &config
+  }
+}
+
+// WithCache makes RunLLM reuse the responses of the same requests.
+func WithCache(cache *Cache) ClientOption {
+  return func(c *AnthropicClient) {
+    c.cache = cache
+  }
+}
+
+// WithUsageLedger records the tokens and cost of every request and enforces
+// the monthly budget from the config.
+func WithUsageLedger(ledger *UsageLedger) ClientOption {
+  return func(c *AnthropicClient) {
+    c.ledger = ledger
+  }
+}
+
+// WithHttpClient replaces the http client used for the requests, e.g. to set
+// up a proxy, custom TLS config or different timeouts.
+func WithHttpClient(httpClient *http.Client) ClientOption {
+  return func(c *AnthropicClient) {
+    c.httpClient = httpClient
+  }
+}
+
+// WithTransport keeps the default client (and its timeout) but swaps the
+// underlying transport.
+func WithTransport(transport http.RoundTripper) ClientOption {
+  return func(c *AnthropicClient) {
+    c.httpClient = &http.Client{
+      Timeout: c.httpClient.Timeout,
+      Transport: transport,
+    }
+  }
+}
+
+// WithTimeout sets the timeout of the whole request, including reading the
+// response body. A streamed response has it for every next piece instead.
+func WithTimeout(timeout time.Duration) ClientOption {
+  return func(c *AnthropicClient) {
+    httpClient := *c.httpClient
+    httpClient.Timeout = timeout
+    c.httpClient = &httpClient
+  }
+}
+
+func (c *AnthropicClient) createRequest(ctx context.Context, method string, body map[string]interface{}) (*http.Request, error) {
+  messages, _ := body["messages"].([]Message)
+  req, err := c.newRequest(ctx, method, c.config.BaseUrl + "/v1/messages/", body, hasDocuments(messages))
   if err != nil {
     return nil, err
   }
 
-  url := c.baseUrl + "/v1/messages/"
-  req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
+  l.Print("With body: ", utils.PrettyPrint(loggableBody(body)))
+
+  return req, nil
+}
+
+// newRequest creates an authenticated request to the API, body can be nil.
+func (c *AnthropicClient) newRequest(ctx context.Context, method string, url string, body interface{}, documents bool) (*http.Request, error) {
+  var reader io.Reader
+  if body != nil {
+    jsonBody, err := json.Marshal(body)
+    if err != nil {
+      return nil, err
+    }
+    reader = bytes.NewBuffer(jsonBody)
+  }
+
+  req, err := http.NewRequestWithContext(ctx, method, url, reader)
   if err != nil {
     return nil, err
   }
 
   l.Print("Sending request to: ", url)
-  l.Print("With body: ", utils.PrettyPrint(body))
 
   req.Header.Set("x-api-key", c.apiKey)
   req.Header.Set("Content-Type", "application/json")
-  req.Header.Set("anthropic-version", "2023-06-01")
+  req.Header.Set("anthropic-version", c.config.Version)
+
+  if documents {
+    req.Header.Set("anthropic-beta", PDF_BETA)
+  }
 
   return req, nil
 }
 
 func (c *AnthropicClient) mapResponse(response anthropicResponse) (*AiResponse, error) {
-  var res *AiResponse
-
   l.Print("Got response: ", utils.PrettyPrint(response))
 
-  switch response.Content[0].Type {
-    case "text":
-      res = &AiResponse {
-        Message: Message {
-          Role: response.Role,
-          Content: response.Content[0].Text,
-        },
-      }
-    case "tool_use":
-      res = &AiResponse {
-        JsonOutput: response.Content[0].Input,
-      }
+  if len(response.Content) == 0 {
+    return nil, fmt.Errorf("%w (stop reason: %s)", ErrEmptyResponse, response.StopReason)
+  }
+
+  res := &AiResponse{
+    Message: Message{
+      Role: response.Role,
+    },
+    StopReason: response.StopReason,
+    Model: response.Model,
+  }
+
+  for _, content := range response.Content {
+    switch content.Type {
+      case "text":
+        res.Message.Content = append(res.Message.Content, TextBlock(content.Text))
+      case "tool_use":
+        res.ToolCalls = append(res.ToolCalls, ToolCall{
+          Id: content.Id,
+          Name: content.Name,
+          Input: content.Input,
+        })
+        if content.Name == TOOL_NAME && res.JsonOutput == nil {
+          res.JsonOutput = content.Input
+        }
+      default:
+        l.Warn().Str("type", content.Type).Msg("Skipping unknown content block")
+    }
   }
 
   return res, nil 
 }
 
-func (c *AnthropicClient) sendRequest(req *http.Request) (*AiResponse, error) {
-  client := &http.Client{}
-  resp, err := client.Do(req)
+// checkResponse turns the responses we can't use into errors. A truncated tool
+// call has incomplete input, so it's an error even if the call is there.
+func checkResponse(res *AiResponse, expectToolCall bool) error {
+  if res.StopReason == "max_tokens" {
+    return ErrTruncated
+  }
+
+  if expectToolCall && res.JsonOutput == nil {
+    return fmt.Errorf("%w (stop reason: %s)", ErrNoToolCall, res.StopReason)
+  }
+
+  return nil
+}
+
+func (c *AnthropicClient) usage(response anthropicResponse) Usage {
+  cost, ok := c.config.Cost(response.Model, response.Usage.InputTokens, response.Usage.OutputTokens)
+  if !ok {
+    l.Warn().Str("model", response.Model).Msg("No price for the model, the cost is not counted")
+  }
+
+  return Usage{
+    InputTokens: response.Usage.InputTokens,
+    OutputTokens: response.Usage.OutputTokens,
+    Cost: cost,
+  }
+}
+
+func (c *AnthropicClient) checkBudget() error {
+  if c.ledger == nil || c.config.MonthlyBudget <= 0 {
+    return nil
+  }
+
+  spent := c.ledger.Month(time.Now()).Cost
+  if spent >= c.config.MonthlyBudget {
+    return fmt.Errorf("%w: spent $%.2f of $%.2f", ErrBudgetExceeded, spent, c.config.MonthlyBudget)
+  }
+
+  return nil
+}
+
+func (c *AnthropicClient) recordUsage(usage Usage) {
+  if c.ledger == nil {
+    return
+  }
+
+  if err := c.ledger.Record(usage); err != nil {
+    l.Error().Err(err).Msg("Failed to record the AI usage")
+  }
+}
+
+func (c *AnthropicClient) sendRequest(req *http.Request, handler StreamHandler) (*AiResponse, error) {
+  if err := c.checkBudget(); err != nil {
+    return nil, err
+  }
+
+  aResp, err := c.receive(req, handler)
+  if err != nil {
+    return nil, err
+  }
+
+  // Failed responses are paid for too.
+  usage := c.usage(*aResp)
+  c.recordUsage(usage)
+
+  res, err := c.mapResponse(*aResp)
   if err != nil {
     return nil, err
   }
+  res.Usage = usage
+
+  return res, nil
+}
+
+// do sends the request and reads the response, retrying the rate limits and
+// overloads with a backoff.
+func (c *AnthropicClient) do(req *http.Request) (int, []byte, error) {
+  resp, err := c.send(c.httpClient, req)
+  if err != nil {
+    return 0, nil, err
+  }
   defer resp.Body.Close()
 
-  // Read the response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
-	}
+  body, err := io.ReadAll(resp.Body)
+  if err != nil {
+    return 0, nil, fmt.Errorf("error reading response: %v", err)
+  }
+
+  return resp.StatusCode, body, nil
+}
+
+// send is do without reading the body, for the streamed responses. The caller
+// closes the body.
+func (c *AnthropicClient) send(httpClient *http.Client, req *http.Request) (*http.Response, error) {
+  for attempt := 0; ; attempt++ {
+    resp, err := httpClient.Do(req)
+    if err != nil {
+      return nil, err
+    }
+
+    if !isRetryable(resp.StatusCode) || attempt >= c.config.MaxRetries {
+      return resp, nil
+    }
+
+    // Drain it so the connection can be reused.
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+
+    delay := retryDelay(resp.Header.Get("retry-after"), attempt)
+    l.Print("Request failed with status code ", resp.StatusCode, ", retrying in ", delay, ".")
+
+    select {
+    case <-req.Context().Done():
+      return nil, req.Context().Err()
+    case <-time.After(delay):
+    }
 
-	// Print the response
-  if resp.StatusCode != 200 {
-    return nil, fmt.Errorf("request failed with status code: %d\n%s", resp.StatusCode, string(body))
+    if req.GetBody != nil {
+      req.Body, err = req.GetBody()
+      if err != nil {
+        return nil, err
+      }
+    }
+  }
+}
+
+func isRetryable(statusCode int) bool {
+  switch statusCode {
+  case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+    http.StatusServiceUnavailable, http.StatusGatewayTimeout, STATUS_OVERLOADED:
+    return true
+  }
+  return false
+}
+
+// retryDelay follows the retry-after header (in seconds) when there is one,
+// otherwise it doubles with every attempt.
+func retryDelay(retryAfter string, attempt int) time.Duration {
+  if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+    return min(time.Duration(seconds)*time.Second, MAX_RETRY_DELAY)
+  }
+  return min(time.Second<<attempt, MAX_RETRY_DELAY)
+}
+
+// receive reads the whole response, from the stream when there is a handler.
+func (c *AnthropicClient) receive(req *http.Request, handler StreamHandler) (*anthropicResponse, error) {
+  if handler != nil {
+    return c.receiveStream(req, handler)
+  }
+
+  statusCode, body, err := c.do(req)
+  if err != nil {
+    return nil, err
+  }
+
+  if statusCode != 200 {
+    return nil, &APIError{StatusCode: statusCode, Body: string(body)}
   }
 
   aResp := &anthropicResponse{}
@@ -138,27 +432,122 @@ func (c *AnthropicClient) sendRequest(req *http.Request) (*AiResponse, error) {
     return nil, fmt.Errorf("error unmarshalling response: %v", err)
   }
 
-  return c.mapResponse(*aResp)
+  return aResp, nil
+}
+
+func (c *AnthropicClient) post(ctx context.Context, requestBody map[string]interface{}, expectToolCall bool) (*AiResponse, error) {
+  handler := streamHandler(ctx)
+  if handler != nil {
+    // A copy, the body without it is a part of the cache key.
+    streamed := make(map[string]interface{}, len(requestBody) + 1)
+    for key, value := range requestBody {
+      streamed[key] = value
+    }
+    streamed["stream"] = true
+    requestBody = streamed
+  }
+
+  req, err := c.createRequest(ctx, "POST", requestBody)
+  if err != nil {
+    return nil, err
+  }
+
+  res, err := c.sendRequest(req, handler)
+  if err != nil {
+    return nil, err
+  }
+
+  return res, checkResponse(res, expectToolCall)
+}
+
+// postWithRetry retries a truncated response once, with a doubled budget.
+func (c *AnthropicClient) postWithRetry(ctx context.Context, requestBody map[string]interface{}, expectToolCall bool) (*AiResponse, error) {
+  res, err := c.post(ctx, requestBody, expectToolCall)
+  if !errors.Is(err, ErrTruncated) {
+    return res, err
+  }
+
+  maxTokens, _ := requestBody["max_tokens"].(int)
+  retryMaxTokens := min(maxTokens*2, MAX_OUTPUT_TOKENS)
+  if retryMaxTokens <= maxTokens {
+    return nil, fmt.Errorf("%w at %d tokens", ErrTruncated, maxTokens)
+  }
+
+  l.Print("Response truncated at ", maxTokens, " tokens, retrying with ", retryMaxTokens, ".")
+  requestBody["max_tokens"] = retryMaxTokens
+
+  res, err = c.post(ctx, requestBody, expectToolCall)
+  if errors.Is(err, ErrTruncated) {
+    return nil, fmt.Errorf("%w at %d tokens", ErrTruncated, retryMaxTokens)
+  }
+
+  return res, err
+}
+
+// llmRequest is a task turned into the request body, ready to be sent on its
+// own or as a part of a batch.
+type llmRequest struct {
+  body map[string]interface{}
+  cacheKey string
 }
 
-func (c *AnthropicClient) RunLLM(llm LLM) (*AiResponse, error) {
+// RunLLM asks the model of the task, or goes through the models of its route
+// when there is one in Config.Routes.
+func (c *AnthropicClient) RunLLM(ctx context.Context, llm LLM) (*AiResponse, error) {
+  if route, ok := c.config.Routes[llm.GetName()]; ok && len(route.Models) > 0 {
+    return c.runRoute(ctx, llm, route)
+  }
+
+  return c.runModel(ctx, llm, "", c.config.MaxAttempts)
+}
+
+// runModel runs the task with the given model, empty means the one from the
+// config.
+func (c *AnthropicClient) runModel(ctx context.Context, llm LLM, model string, maxAttempts int) (*AiResponse, error) {
+  request, err := c.prepare(llm, model)
+  if err != nil {
+    return nil, err
+  }
+
+  if cached, ok := c.cached(llm, request); ok {
+    return cached, nil
+  }
+
+  return c.runAttempts(ctx, llm, request, nil, maxAttempts)
+}
+
+func (c *AnthropicClient) prepare(llm LLM, model string) (*llmRequest, error) {
   chatMessages, err := llm.GenerateChat()
 
   if err != nil {
     return nil, err
   }
 
+  settings := c.config.ForTask(llm.GetName())
+  if model != "" {
+    settings.Model = model
+  }
+  system, chatMessages := splitSystem(chatMessages)
+
   requestBody := map[string]interface{}{
-    "model": MODEL,
-    "max_tokens": llm.GetMaxTokens(),
+    "model": settings.Model,
+    "max_tokens": settings.MaxTokens,
     "messages": chatMessages,
     "tool_choice": map[string]interface{} {
       "type": "tool",
-      "name": "data_extractor",
+      "name": TOOL_NAME,
       "disable_parallel_tool_use": false,
     },
   }
 
+  if settings.Temperature != nil {
+    requestBody["temperature"] = *settings.Temperature
+  }
+
+  if system != "" {
+    requestBody["system"] = system
+  }
+
   outputSchema := llm.GetOutputSchema()
   if outputSchema != nil {
     inputSchemaProperties := make(map[string]inputSchemaProperty)
@@ -178,46 +567,173 @@ func (c *AnthropicClient) RunLLM(llm LLM) (*AiResponse, error) {
         Required:   make([]string, 0, len(inputSchemaProperties)),
     }
     
-    // Add all properties to Required for this example
+    // Every property is required unless marked with "required": false
     for key := range inputSchemaProperties {
+        if propMap, ok := outputSchema[key].(map[string]interface{}); ok && propMap["required"] == false {
+            continue
+        }
         inputSchema.Required = append(inputSchema.Required, key)
     }
+    // Keep the request stable, it's a part of the cache key.
+    sort.Strings(inputSchema.Required)
 
     requestBody["tools"] = []anthropicTool{
       {
-        Name: "data_extractor",
+        Name: TOOL_NAME,
         Description: "extract the data to the exact provided format",
         InputSchema: inputSchema,
       },
     }
   }
 
-  req, err := c.createRequest("POST", requestBody)
-  if err != nil {
-    return nil, err
+  request := &llmRequest{body: requestBody}
+  if c.cache != nil {
+    request.cacheKey, err = c.cacheKey(llm, settings, requestBody)
+    if err != nil {
+      return nil, err
+    }
   }
 
-  aiResponse, err := c.sendRequest(req)
+  return request, nil
+}
 
-  if err != nil {
-    return nil, err
+// cached returns the cached response if it still passes the validation.
+func (c *AnthropicClient) cached(llm LLM, request *llmRequest) (*AiResponse, bool) {
+  if c.cache == nil {
+    return nil, false
+  }
+
+  cached, ok := c.cache.Get(request.cacheKey)
+  if !ok {
+    return nil, false
+  }
+
+  llm.SetAiResponse(cached)
+  if err := validate(llm); err != nil {
+    l.Print("Cached response for ", llm.GetName(), " is no longer valid, asking again.")
+    return nil, false
+  }
+
+  l.Print("Cache hit for ", llm.GetName(), " (", request.cacheKey[:12], "), skipping the request.")
+  return cached, true
+}
+
+// runAttempts asks the model until the output passes the validation. The first
+// response can come from elsewhere (a batch), then it only counts as the first
+// attempt.
+func (c *AnthropicClient) runAttempts(ctx context.Context, llm LLM, request *llmRequest, aiResponse *AiResponse, maxAttempts int) (*AiResponse, error) {
+  var err error
+  for attempt := 1; ; attempt++ {
+    if aiResponse == nil {
+      aiResponse, err = c.postWithRetry(ctx, request.body, true)
+      if err != nil {
+        return nil, err
+      }
+    }
+
+    aiResponse.PromptVersion = llm.GetPromptVersion()
+    llm.SetAiResponse(aiResponse)
+    validationErr := validate(llm)
+    if validationErr == nil {
+      break
+    }
+
+    l.Warn().Err(validationErr).Int("attempt", attempt).Msg("Invalid output of " + llm.GetName())
+    if attempt >= maxAttempts {
+      return aiResponse, &ValidationError{
+        Attempts: attempt,
+        Output: aiResponse.JsonOutput,
+        PromptVersion: aiResponse.PromptVersion,
+        Err: validationErr,
+      }
+    }
+
+    request.body["messages"] = appendCorrection(request.body["messages"].([]Message), aiResponse, validationErr)
+    aiResponse = nil
+  }
+
+  if c.cache != nil {
+    if err := c.cache.Put(request.cacheKey, aiResponse); err != nil {
+      l.Error().Err(err).Msg("Failed to cache the response")
+    }
   }
 
-  llm.SetAiResponse(aiResponse)
   return aiResponse, nil
 }
 
-func (c *AnthropicClient) AskChat(messages []Message) (*AiResponse, error) {
+func validate(llm LLM) error {
+  validated, ok := llm.(ValidatedLLM)
+  if !ok {
+    return nil
+  }
+  return validated.Validate()
+}
+
+// appendCorrection replies to the tool call with the validation error, so the
+// model can fix its answer in the next turn.
+func appendCorrection(messages []Message, aiResponse *AiResponse, validationErr error) []Message {
+  var toolCall ToolCall
+  for _, call := range aiResponse.ToolCalls {
+    if call.Name == TOOL_NAME {
+      toolCall = call
+      break
+    }
+  }
+
+  corrected := append([]Message{}, messages...)
+  return append(corrected,
+    NewMessage("assistant", ToolUseBlock(toolCall)),
+    NewMessage("user", ToolResultBlock(
+      toolCall.Id,
+      "The output is invalid: " + validationErr.Error() + "\nCall the tool again with the corrected values.",
+      true,
+    )),
+  )
+}
+
+// cacheKey covers everything that changes the answer: the document (as a part
+// of the messages), the task and its prompt version, the model and the schema.
+func (c *AnthropicClient) cacheKey(llm LLM, settings ModelSettings, requestBody map[string]interface{}) (string, error) {
+  document, err := json.Marshal([]interface{}{requestBody["system"], requestBody["messages"]})
+  if err != nil {
+    return "", err
+  }
+
+  schema, err := json.Marshal(requestBody["tools"])
+  if err != nil {
+    return "", err
+  }
+
+  return CacheKey(
+    string(document),
+    llm.GetName(),
+    llm.GetPromptVersion(),
+    settings.Model,
+    string(schema),
+  ), nil
+}
+
+func (c *AnthropicClient) AskChat(ctx context.Context, messages []Message) (*AiResponse, error) {
+  return c.postWithRetry(ctx, c.chatRequest(messages), false)
+}
+
+func (c *AnthropicClient) chatRequest(messages []Message) map[string]interface{} {
+  settings := c.config.Default
+  system, messages := splitSystem(messages)
+
   requestBody := map[string]interface{}{
-    "model": MODEL,
-    "max_tokens": 4096,
+    "model": settings.Model,
+    "max_tokens": settings.MaxTokens,
     "messages": messages,
   }
 
-  req, err := c.createRequest("POST", requestBody)
-  if err != nil {
-    return nil, err
+  if settings.Temperature != nil {
+    requestBody["temperature"] = *settings.Temperature
+  }
+
+  if system != "" {
+    requestBody["system"] = system
   }
 
-  return c.sendRequest(req)
+  return requestBody
 }
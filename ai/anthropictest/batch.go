@@ -0,0 +1,136 @@
+package anthropictest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type batch struct {
+  id string
+  polls int
+  canceled bool
+  results []map[string]interface{}
+}
+
+// handleBatch fakes the Message Batches API. Every request of a new batch
+// takes the next queued response, the batch ends after BatchPolls polls.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request, request Request) {
+  path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/messages/batches"), "/")
+  id, action, _ := strings.Cut(path, "/")
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.requests = append(s.requests, request)
+
+  if id == "" && r.Method == http.MethodPost {
+    writeJSON(w, http.StatusOK, s.createBatch(request))
+    return
+  }
+
+  b, ok := s.batches[id]
+  if !ok {
+    writeJSON(w, http.StatusNotFound, errorBody("not_found_error", "batch not found"))
+    return
+  }
+
+  switch {
+  case action == "" && r.Method == http.MethodGet:
+    b.polls++
+    writeJSON(w, http.StatusOK, s.batchStatus(b))
+  case action == "cancel" && r.Method == http.MethodPost:
+    b.canceled = true
+    writeJSON(w, http.StatusOK, s.batchStatus(b))
+  case action == "results" && r.Method == http.MethodGet:
+    w.Header().Set("Content-Type", "application/x-jsonl")
+    encoder := json.NewEncoder(w)
+    for _, result := range b.results {
+      encoder.Encode(result)
+    }
+  default:
+    writeJSON(w, http.StatusNotFound, errorBody("not_found_error", "unknown batch endpoint"))
+  }
+}
+
+func (s *Server) createBatch(request Request) map[string]interface{} {
+  b := &batch{id: fmt.Sprintf("msgbatch_fake_%d", len(s.batches) + 1)}
+
+  requests, _ := request.Body["requests"].([]interface{})
+  for _, item := range requests {
+    item, _ := item.(map[string]interface{})
+    params, _ := item["params"].(map[string]interface{})
+    model, _ := params["model"].(string)
+
+    response := Response{Status: http.StatusInternalServerError, Body: "no response queued in the fake server"}
+    if len(s.queue) > 0 {
+      response = s.queue[0]
+      s.queue = s.queue[1:]
+    }
+
+    b.results = append(b.results, map[string]interface{}{
+      "custom_id": item["custom_id"],
+      "result": batchResult(model, response),
+    })
+  }
+
+  s.batches[b.id] = b
+  return s.batchStatus(b)
+}
+
+func batchResult(model string, response Response) map[string]interface{} {
+  resultType := response.BatchResult
+  if resultType == "" {
+    resultType = "succeeded"
+    if response.Status != 0 && response.Status != http.StatusOK {
+      resultType = "errored"
+    }
+  }
+
+  switch resultType {
+  case "succeeded":
+    if response.Body != "" {
+      var message map[string]interface{}
+      json.Unmarshal([]byte(response.Body), &message)
+      return map[string]interface{}{"type": resultType, "message": message}
+    }
+    return map[string]interface{}{"type": resultType, "message": message(model, response)}
+  case "errored":
+    var body interface{}
+    if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+      body = errorBody("api_error", response.Body)
+    }
+    return map[string]interface{}{"type": resultType, "error": body}
+  default:
+    return map[string]interface{}{"type": resultType}
+  }
+}
+
+func (s *Server) batchStatus(b *batch) map[string]interface{} {
+  status := "in_progress"
+  if b.canceled {
+    status = "canceling"
+  }
+  if b.polls > s.BatchPolls {
+    status = "ended"
+  }
+
+  counts := map[string]int{"processing": 0, "succeeded": 0, "errored": 0, "canceled": 0, "expired": 0}
+  for _, result := range b.results {
+    if status != "ended" {
+      counts["processing"]++
+      continue
+    }
+    resultType, _ := result["result"].(map[string]interface{})["type"].(string)
+    counts[resultType]++
+  }
+
+  return map[string]interface{}{
+    "id": b.id,
+    "type": "message_batch",
+    "processing_status": status,
+    "request_counts": counts,
+    "results_url": s.URL + "/v1/messages/batches/" + b.id + "/results",
+  }
+}
@@ -0,0 +1,271 @@
+// Package anthropictest is a fake of the Messages API for the tests, in the
+// spirit of net/http/httptest.
+package anthropictest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response is what the server answers with, in the order they were queued.
+type Response struct {
+  Status int
+  Header map[string]string
+  // Raw JSON body. Empty means a message built from the fields below.
+  Body string
+  Latency time.Duration
+
+  Content []map[string]interface{}
+  StopReason string
+  InputTokens int
+  OutputTokens int
+
+  // In a batch: succeeded, errored, canceled or expired. Empty means
+  // succeeded, or errored for an error status.
+  BatchResult string
+  // Type of an error event sent in the middle of a streamed response, e.g.
+  // overloaded_error.
+  StreamError string
+}
+
+// Request is a request the server received.
+type Request struct {
+  Path string
+  Header http.Header
+  Body map[string]interface{}
+}
+
+type Server struct {
+  *httptest.Server
+
+  mu sync.Mutex
+  queue []Response
+  requests []Request
+  batches map[string]*batch
+
+  // How many times a batch is polled before it ends.
+  BatchPolls int
+}
+
+func NewServer() *Server {
+  s := &Server{batches: map[string]*batch{}}
+  s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+  return s
+}
+
+// Enqueue adds the responses for the next requests. When the queue is empty
+// the server answers with 500.
+func (s *Server) Enqueue(responses ...Response) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.queue = append(s.queue, responses...)
+}
+
+func (s *Server) Requests() []Request {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  return append([]Request{}, s.requests...)
+}
+
+func (s *Server) next(request Request) (Response, bool) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.requests = append(s.requests, request)
+  if len(s.queue) == 0 {
+    return Response{}, false
+  }
+
+  response := s.queue[0]
+  s.queue = s.queue[1:]
+  return response, true
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+  request := Request{
+    Path: r.URL.Path,
+    Header: r.Header.Clone(),
+  }
+  data, _ := io.ReadAll(r.Body)
+  json.Unmarshal(data, &request.Body)
+
+  if strings.HasPrefix(r.URL.Path, "/v1/messages/batches") {
+    s.handleBatch(w, r, request)
+    return
+  }
+
+  response, ok := s.next(request)
+  if !ok {
+    writeJSON(w, http.StatusInternalServerError, errorBody("api_error", "no response queued in the fake server"))
+    return
+  }
+
+  if response.Latency > 0 {
+    select {
+    case <-time.After(response.Latency):
+    case <-r.Context().Done():
+      return
+    }
+  }
+
+  for key, value := range response.Header {
+    w.Header().Set(key, value)
+  }
+
+  status := response.Status
+  if status == 0 {
+    status = http.StatusOK
+  }
+
+  model, _ := request.Body["model"].(string)
+  if stream, _ := request.Body["stream"].(bool); stream && status == http.StatusOK {
+    body := message(model, response)
+    if response.Body != "" {
+      body = map[string]interface{}{}
+      json.Unmarshal([]byte(response.Body), &body)
+    }
+    writeStream(w, body, response.StreamError)
+    return
+  }
+
+  if response.Body != "" {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    io.WriteString(w, response.Body)
+    return
+  }
+
+  writeJSON(w, status, message(model, response))
+}
+
+func message(model string, response Response) map[string]interface{} {
+  return map[string]interface{}{
+    "id": "msg_fake",
+    "type": "message",
+    "role": "assistant",
+    "model": model,
+    "content": response.Content,
+    "stop_reason": response.StopReason,
+    "usage": map[string]int{
+      "input_tokens": response.InputTokens,
+      "output_tokens": response.OutputTokens,
+    },
+  }
+}
+
+func errorBody(errorType string, text string) map[string]interface{} {
+  return map[string]interface{}{
+    "type": "error",
+    "error": map[string]string{
+      "type": errorType,
+      "message": text,
+    },
+  }
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(body)
+}
+
+// ToolUse answers with a data_extractor call.
+func ToolUse(input map[string]interface{}) Response {
+  return ToolCall("toolu_fake", "data_extractor", input)
+}
+
+// ToolCall answers with a call of any tool, for the chats with tools.
+func ToolCall(id string, name string, input map[string]interface{}) Response {
+  return Response{
+    Content: []map[string]interface{}{
+      {"type": "tool_use", "id": id, "name": name, "input": input},
+    },
+    StopReason: "tool_use",
+    InputTokens: 1000,
+    OutputTokens: 50,
+  }
+}
+
+func Text(text string) Response {
+  return Response{
+    Content: []map[string]interface{}{
+      {"type": "text", "text": text},
+    },
+    StopReason: "end_turn",
+    InputTokens: 1000,
+    OutputTokens: 50,
+  }
+}
+
+// Truncated is a tool call cut off by max_tokens.
+func Truncated(input map[string]interface{}) Response {
+  response := ToolUse(input)
+  response.StopReason = "max_tokens"
+  return response
+}
+
+func Error(status int, errorType string, text string) Response {
+  data, _ := json.Marshal(errorBody(errorType, text))
+  return Response{
+    Status: status,
+    Body: string(data),
+  }
+}
+
+// Expired is a batch request that wasn't processed in time.
+func Expired() Response {
+  return Response{BatchResult: "expired"}
+}
+
+func RateLimited(retryAfter time.Duration) Response {
+  return withRetryAfter(Error(http.StatusTooManyRequests, "rate_limit_error", "rate limited"), retryAfter)
+}
+
+func Overloaded(retryAfter time.Duration) Response {
+  return withRetryAfter(Error(529, "overloaded_error", "overloaded"), retryAfter)
+}
+
+func withRetryAfter(response Response, retryAfter time.Duration) Response {
+  response.Header = map[string]string{
+    "retry-after": strconv.Itoa(int(retryAfter.Seconds())),
+  }
+  return response
+}
+
+// Recorded serves a response saved from the real API, either the raw body or
+// a recording of ai.ReplayTransport.
+func Recorded(path string) (Response, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return Response{}, err
+  }
+
+  var recording struct {
+    Status int `json:"status"`
+    Body *string `json:"body"`
+  }
+  if err := json.Unmarshal(data, &recording); err != nil {
+    return Response{}, fmt.Errorf("error unmarshalling %s: %v", path, err)
+  }
+
+  if recording.Body != nil {
+    return Response{Status: recording.Status, Body: *recording.Body}, nil
+  }
+  return Response{Body: string(data)}, nil
+}
+
+// WithLatency delays the response, e.g. to test the timeouts.
+func (r Response) WithLatency(latency time.Duration) Response {
+  r.Latency = latency
+  return r
+}
@@ -0,0 +1,105 @@
+package anthropictest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// The size of the deltas, small enough to have a few of them in every test.
+const STREAM_CHUNK = 8
+
+// writeStream sends the message as the server-sent events of the Messages
+// API, with the text and the tool input split into deltas.
+func writeStream(w http.ResponseWriter, message map[string]interface{}, streamError string) {
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.WriteHeader(http.StatusOK)
+
+  send := func(eventType string, data map[string]interface{}) {
+    data["type"] = eventType
+    encoded, _ := json.Marshal(data)
+    fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, encoded)
+    if flusher, ok := w.(http.Flusher); ok {
+      flusher.Flush()
+    }
+  }
+
+  usage, _ := message["usage"].(map[string]int)
+  if usage == nil {
+    usage = map[string]int{}
+    if raw, ok := message["usage"].(map[string]interface{}); ok {
+      for key, value := range raw {
+        number, _ := value.(float64)
+        usage[key] = int(number)
+      }
+    }
+  }
+
+  start := map[string]interface{}{}
+  for key, value := range message {
+    start[key] = value
+  }
+  start["content"] = []interface{}{}
+  start["stop_reason"] = nil
+  start["usage"] = map[string]int{"input_tokens": usage["input_tokens"], "output_tokens": 1}
+  send("message_start", map[string]interface{}{"message": start})
+  send("ping", map[string]interface{}{})
+
+  if streamError != "" {
+    send("error", map[string]interface{}{"error": map[string]string{"type": streamError, "message": streamError}})
+    return
+  }
+
+  for i, block := range contentBlocks(message["content"]) {
+    switch block["type"] {
+    case "text":
+      text, _ := block["text"].(string)
+      send("content_block_start", map[string]interface{}{"index": i, "content_block": map[string]interface{}{"type": "text", "text": ""}})
+      for _, chunk := range chunks(text) {
+        send("content_block_delta", map[string]interface{}{"index": i, "delta": map[string]interface{}{"type": "text_delta", "text": chunk}})
+      }
+    case "tool_use":
+      input, _ := json.Marshal(block["input"])
+      send("content_block_start", map[string]interface{}{"index": i, "content_block": map[string]interface{}{
+        "type": "tool_use", "id": block["id"], "name": block["name"], "input": map[string]interface{}{},
+      }})
+      for _, chunk := range chunks(string(input)) {
+        send("content_block_delta", map[string]interface{}{"index": i, "delta": map[string]interface{}{"type": "input_json_delta", "partial_json": chunk}})
+      }
+    }
+    send("content_block_stop", map[string]interface{}{"index": i})
+  }
+
+  send("message_delta", map[string]interface{}{
+    "delta": map[string]interface{}{"stop_reason": message["stop_reason"], "stop_sequence": nil},
+    "usage": map[string]int{"output_tokens": usage["output_tokens"]},
+  })
+  send("message_stop", map[string]interface{}{})
+}
+
+// contentBlocks accepts both the blocks of a Response and the ones decoded
+// from a raw body.
+func contentBlocks(content interface{}) []map[string]interface{} {
+  switch blocks := content.(type) {
+  case []map[string]interface{}:
+    return blocks
+  case []interface{}:
+    result := make([]map[string]interface{}, 0, len(blocks))
+    for _, block := range blocks {
+      if block, ok := block.(map[string]interface{}); ok {
+        result = append(result, block)
+      }
+    }
+    return result
+  }
+  return nil
+}
+
+func chunks(text string) []string {
+  runes := []rune(text)
+  result := []string{}
+  for start := 0; start < len(runes); start += STREAM_CHUNK {
+    result = append(result, string(runes[start:min(start + STREAM_CHUNK, len(runes))]))
+  }
+  return result
+}
@@ -0,0 +1,287 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The API takes up to 100 000 requests per batch, but with the PDFs attached
+// the 256 MB size limit comes first.
+const MAX_BATCH_REQUESTS = 500
+
+// BatchResult is the outcome of one task of a batch, the same as RunLLM would
+// return for it.
+type BatchResult struct {
+  Response *AiResponse
+  Err error
+}
+
+type anthropicBatchRequest struct {
+  CustomId string `json:"custom_id"`
+  Params map[string]interface{} `json:"params"`
+}
+
+type anthropicBatch struct {
+  Id string `json:"id"`
+  ProcessingStatus string `json:"processing_status"`
+  RequestCounts map[string]int `json:"request_counts"`
+  ResultsUrl string `json:"results_url"`
+}
+
+type anthropicBatchResult struct {
+  CustomId string `json:"custom_id"`
+  Result struct {
+    // succeeded, errored, canceled or expired
+    Type string `json:"type"`
+    Message anthropicResponse `json:"message"`
+    Error json.RawMessage `json:"error"`
+  } `json:"result"`
+}
+
+// RunBatch runs the tasks through the Message Batches API, at half the price
+// but with results coming in minutes to hours. The results are in the order of
+// the tasks, and every task gets its response set like with RunLLM.
+//
+// The cached tasks are not sent. Everything that didn't succeed in the batch
+// (errors, expired requests, truncated or invalid outputs) is retried with
+// regular requests, one by one. Routed tasks send their first model in the
+// batch and escalate with regular requests, the ones comparing models don't
+// go into the batch at all. The error is only returned when the batch itself
+// fails.
+func (c *AnthropicClient) RunBatch(ctx context.Context, llms []LLM) ([]BatchResult, error) {
+  results := make([]BatchResult, len(llms))
+  requests := make([]*llmRequest, len(llms))
+  done := make([]bool, len(llms))
+
+  pending := []int{}
+  for i, llm := range llms {
+    route, routed := c.config.Routes[llm.GetName()]
+    if routed && len(route.Compare) > 0 {
+      continue
+    }
+
+    model := ""
+    if routed && len(route.Models) > 0 {
+      model = route.Models[0]
+    }
+
+    request, err := c.prepare(llm, model)
+    if err != nil {
+      results[i].Err = err
+      done[i] = true
+      continue
+    }
+    requests[i] = request
+
+    if cached, ok := c.cached(llm, request); ok {
+      results[i].Response, results[i].Err = c.continueBatchTask(ctx, llm, cached, nil)
+      done[i] = true
+      continue
+    }
+    pending = append(pending, i)
+  }
+
+  for start := 0; start < len(pending); start += MAX_BATCH_REQUESTS {
+    chunk := pending[start:min(start + MAX_BATCH_REQUESTS, len(pending))]
+
+    responses, err := c.runBatch(ctx, chunk, requests)
+    if err != nil {
+      return nil, err
+    }
+
+    for _, i := range chunk {
+      response, ok := responses[i]
+      if !ok {
+        l.Print("No batch result for ", llms[i].GetName(), " #", i, ", retrying on its own.")
+      }
+
+      maxAttempts := c.config.MaxAttempts
+      if route, routed := c.config.Routes[llms[i].GetName()]; routed && len(route.Models) > 0 {
+        maxAttempts = route.attempts(0, c.config.MaxAttempts)
+      }
+
+      res, err := c.runAttempts(ctx, llms[i], requests[i], response, maxAttempts)
+      results[i].Response, results[i].Err = c.continueBatchTask(ctx, llms[i], res, err)
+      done[i] = true
+    }
+  }
+
+  for i, llm := range llms {
+    if !done[i] {
+      results[i].Response, results[i].Err = c.RunLLM(ctx, llm)
+    }
+  }
+
+  return results, nil
+}
+
+// continueBatchTask takes the answer of the first model of a routed task up
+// the route, if it isn't good enough.
+func (c *AnthropicClient) continueBatchTask(ctx context.Context, llm LLM, res *AiResponse, err error) (*AiResponse, error) {
+  route, routed := c.config.Routes[llm.GetName()]
+  if !routed || len(route.Models) == 0 {
+    return res, err
+  }
+
+  path, done := c.judge(llm, route, 0, res, err, nil)
+  if !done {
+    return c.continueRoute(ctx, llm, route, 1, path)
+  }
+
+  if res != nil {
+    res.Route = path
+  }
+  return res, err
+}
+
+// runBatch submits the requests and waits for the batch to end. Only the
+// usable responses are returned, keyed by the index of the task.
+func (c *AnthropicClient) runBatch(ctx context.Context, indexes []int, requests []*llmRequest) (map[int]*AiResponse, error) {
+  if err := c.checkBudget(); err != nil {
+    return nil, err
+  }
+
+  batchRequests := make([]anthropicBatchRequest, len(indexes))
+  documents := false
+  for j, i := range indexes {
+    batchRequests[j] = anthropicBatchRequest{
+      CustomId: fmt.Sprintf("task-%d", i),
+      Params: requests[i].body,
+    }
+
+    messages, _ := requests[i].body["messages"].([]Message)
+    documents = documents || hasDocuments(messages)
+  }
+
+  batch := &anthropicBatch{}
+  err := c.batchRequest(ctx, "POST", c.config.BaseUrl + "/v1/messages/batches", map[string]interface{}{
+    "requests": batchRequests,
+  }, documents, batch)
+  if err != nil {
+    return nil, fmt.Errorf("error creating batch: %w", err)
+  }
+  l.Print("Created batch ", batch.Id, " with ", len(batchRequests), " requests.")
+
+  for batch.ProcessingStatus != "ended" {
+    select {
+    case <-ctx.Done():
+      c.cancelBatch(batch.Id)
+      return nil, ctx.Err()
+    case <-time.After(c.config.BatchPollInterval):
+    }
+
+    err = c.batchRequest(ctx, "GET", c.config.BaseUrl + "/v1/messages/batches/" + batch.Id, nil, false, batch)
+    if ctx.Err() != nil {
+      c.cancelBatch(batch.Id)
+      return nil, ctx.Err()
+    }
+    if err != nil {
+      return nil, fmt.Errorf("error polling batch %s: %w", batch.Id, err)
+    }
+    l.Print("Batch ", batch.Id, " is ", batch.ProcessingStatus, ": ", batch.RequestCounts)
+  }
+
+  return c.batchResults(ctx, batch)
+}
+
+func (c *AnthropicClient) batchResults(ctx context.Context, batch *anthropicBatch) (map[int]*AiResponse, error) {
+  url := batch.ResultsUrl
+  if url == "" {
+    url = c.config.BaseUrl + "/v1/messages/batches/" + batch.Id + "/results"
+  }
+
+  req, err := c.newRequest(ctx, "GET", url, nil, false)
+  if err != nil {
+    return nil, err
+  }
+
+  statusCode, body, err := c.do(req)
+  if err != nil {
+    return nil, fmt.Errorf("error fetching results of batch %s: %w", batch.Id, err)
+  }
+  if statusCode != http.StatusOK {
+    return nil, &APIError{StatusCode: statusCode, Body: string(body)}
+  }
+
+  responses := map[int]*AiResponse{}
+
+  // The results are JSON lines, in any order.
+  decoder := json.NewDecoder(bytes.NewReader(body))
+  for decoder.More() {
+    result := anthropicBatchResult{}
+    if err := decoder.Decode(&result); err != nil {
+      return nil, fmt.Errorf("error unmarshalling results of batch %s: %v", batch.Id, err)
+    }
+
+    var i int
+    if _, err := fmt.Sscanf(result.CustomId, "task-%d", &i); err != nil {
+      l.Warn().Str("customId", result.CustomId).Msg("Skipping unknown batch result")
+      continue
+    }
+
+    if result.Result.Type != "succeeded" {
+      l.Warn().Str("customId", result.CustomId).Str("type", result.Result.Type).Str("error", string(result.Result.Error)).Msg("Batch request failed")
+      continue
+    }
+
+    // Failed responses are paid for too.
+    usage := c.usage(result.Result.Message)
+    usage.Cost *= BATCH_DISCOUNT
+    c.recordUsage(usage)
+
+    res, err := c.mapResponse(result.Result.Message)
+    if err == nil {
+      err = checkResponse(res, true)
+    }
+    if err != nil {
+      l.Warn().Err(err).Str("customId", result.CustomId).Msg("Unusable batch result")
+      continue
+    }
+    res.Usage = usage
+
+    responses[i] = res
+  }
+
+  return responses, nil
+}
+
+// batchRequest sends a request to the batches API and decodes the answer into
+// the result.
+func (c *AnthropicClient) batchRequest(ctx context.Context, method string, url string, body interface{}, documents bool, result interface{}) error {
+  req, err := c.newRequest(ctx, method, url, body, documents)
+  if err != nil {
+    return err
+  }
+
+  statusCode, resBody, err := c.do(req)
+  if err != nil {
+    return err
+  }
+  if statusCode != http.StatusOK {
+    return &APIError{StatusCode: statusCode, Body: string(resBody)}
+  }
+
+  if err := json.Unmarshal(resBody, result); err != nil {
+    return fmt.Errorf("error unmarshalling response: %v", err)
+  }
+
+  return nil
+}
+
+// cancelBatch stops the requests that haven't been processed yet, the
+// processed ones are paid for anyway.
+func (c *AnthropicClient) cancelBatch(id string) {
+  ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+  defer cancel()
+
+  err := c.batchRequest(ctx, "POST", c.config.BaseUrl + "/v1/messages/batches/" + id + "/cancel", nil, false, &anthropicBatch{})
+  if err != nil {
+    l.Error().Err(err).Str("batch", id).Msg("Failed to cancel the batch")
+    return
+  }
+  l.Print("Canceled batch ", id, ".")
+}
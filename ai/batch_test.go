@@ -0,0 +1,130 @@
+package ai_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/ai/anthropictest"
+	"github.com/krol22/invoice_go_sort_sort/ai/llm"
+)
+
+func TestRunBatchMapsResultsToTasks(t *testing.T) {
+  ledger := ai.NewUsageLedger()
+  client, server := newTestClient(t, ai.WithUsageLedger(ledger))
+  server.BatchPolls = 2
+  server.Enqueue(
+    anthropictest.ToolUse(validOutput()),
+    anthropictest.ToolUse(map[string]interface{}{"date": "2024-03-14", "dateConfidence": 0.8}),
+  )
+
+  other := llm.NewAnalyzeInvoiceLLM(&llm.AnalyzeInvoiceLLMInput{
+    Invoice: "FAKTURA VAT nr 2/03/2024\nData: 14.03.2024",
+    ReceivedAt: time.Date(2024, 3, 16, 10, 0, 0, 0, time.UTC),
+  })
+  tasks := []*llm.AnalyzeInvoiceLLM{newAnalyzeInvoice(), other}
+  results, err := client.RunBatch(context.Background(), []ai.LLM{tasks[0], tasks[1]})
+  if err != nil {
+    t.Fatalf("RunBatch: %v", err)
+  }
+
+  for i, want := range []string{"2024-03-15", "2024-03-14"} {
+    if results[i].Err != nil {
+      t.Errorf("task %d: %v", i, results[i].Err)
+    }
+    if got := tasks[i].GetOutput().InvoiceDate; got != want {
+      t.Errorf("task %d: InvoiceDate = %q, want %s", i, got, want)
+    }
+  }
+
+  // Create, three polls and the results.
+  if got := len(server.Requests()); got != 5 {
+    t.Errorf("got %d requests, want 5", got)
+  }
+
+  single, _ := ai.DefaultConfig().Cost(ai.DEFAULT_MODEL, 1000, 50)
+  if got := ledger.Run().Cost; got != single {
+    t.Errorf("Cost = %f, want half of two requests (%f)", got, single)
+  }
+}
+
+func TestRunBatchRetriesFailuresIndividually(t *testing.T) {
+  client, server := newTestClient(t)
+  server.Enqueue(
+    anthropictest.Error(500, "api_error", "internal error"),
+    anthropictest.Expired(),
+    anthropictest.ToolUse(map[string]interface{}{"date": "15.03.2024", "dateConfidence": 0.9}),
+    anthropictest.ToolUse(validOutput()),
+  )
+  // The individual retries, in the order of the tasks.
+  server.Enqueue(
+    anthropictest.ToolUse(validOutput()),
+    anthropictest.ToolUse(validOutput()),
+    anthropictest.ToolUse(validOutput()),
+  )
+
+  tasks := []ai.LLM{newAnalyzeInvoice(), newAnalyzeInvoice(), newAnalyzeInvoice(), newAnalyzeInvoice()}
+  results, err := client.RunBatch(context.Background(), tasks)
+  if err != nil {
+    t.Fatalf("RunBatch: %v", err)
+  }
+
+  for i, result := range results {
+    if result.Err != nil {
+      t.Errorf("task %d: %v", i, result.Err)
+    }
+  }
+
+  requests := server.Requests()
+  retries := requests[len(requests)-3:]
+  for _, request := range retries {
+    if request.Path != "/v1/messages/" {
+      t.Errorf("retry went to %s, want /v1/messages/", request.Path)
+    }
+  }
+
+  // The invalid output is corrected, not asked from scratch.
+  messages := retries[2].Body["messages"].([]interface{})
+  if len(messages) != 3 {
+    t.Errorf("correction has %d messages, want 3", len(messages))
+  }
+}
+
+func TestRunBatchSkipsCachedTasks(t *testing.T) {
+  cache := ai.NewCache(t.TempDir(), time.Hour, 1024*1024)
+  client, server := newTestClient(t, ai.WithCache(cache))
+  server.Enqueue(anthropictest.ToolUse(validOutput()))
+
+  if _, err := client.RunLLM(context.Background(), newAnalyzeInvoice()); err != nil {
+    t.Fatalf("RunLLM: %v", err)
+  }
+
+  results, err := client.RunBatch(context.Background(), []ai.LLM{newAnalyzeInvoice()})
+  if err != nil || results[0].Err != nil {
+    t.Fatalf("RunBatch: %v, %v", err, results[0].Err)
+  }
+  if got := len(server.Requests()); got != 1 {
+    t.Errorf("got %d requests, want no batch", got)
+  }
+}
+
+func TestRunBatchCancelsOnInterrupt(t *testing.T) {
+  client, server := newTestClient(t)
+  server.BatchPolls = 1000
+  server.Enqueue(anthropictest.ToolUse(validOutput()))
+
+  ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+  defer cancel()
+
+  _, err := client.RunBatch(ctx, []ai.LLM{newAnalyzeInvoice()})
+  if !errors.Is(err, context.DeadlineExceeded) {
+    t.Fatalf("err = %v, want the context error", err)
+  }
+
+  requests := server.Requests()
+  if got := requests[len(requests)-1].Path; got != "/v1/messages/batches/msgbatch_fake_1/cancel" {
+    t.Errorf("last request = %s, want the cancel", got)
+  }
+}
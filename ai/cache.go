@@ -0,0 +1,204 @@
+package ai
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/env"
+)
+
+const (
+  DEFAULT_CACHE_TTL = 30 * 24 * time.Hour
+  DEFAULT_CACHE_MAX_SIZE = 100 * 1024 * 1024
+)
+
+// Cache keeps the responses on disk, one JSON file per key, so re-running over
+// the same documents doesn't pay for the same tokens again.
+type Cache struct {
+  dir string
+  ttl time.Duration
+  maxSize int64
+}
+
+type cacheEntry struct {
+  CreatedAt time.Time `json:"createdAt"`
+  Response *AiResponse `json:"response"`
+}
+
+func NewCache(dir string, ttl time.Duration, maxSize int64) *Cache {
+  return &Cache{
+    dir: dir,
+    ttl: ttl,
+    maxSize: maxSize,
+  }
+}
+
+// LoadCache creates the cache from CACHE_DIR, CACHE_TTL (e.g. "720h") and
+// CACHE_MAX_SIZE (in megabytes).
+func LoadCache() (*Cache, error) {
+  dir := env.Get("CACHE_DIR")
+  if dir == "" {
+    cacheDir, err := os.UserCacheDir()
+    if err != nil {
+      return nil, fmt.Errorf("error getting cache directory: %v", err)
+    }
+    dir = filepath.Join(cacheDir, "com.krol22.invoice_go_sort_sort", "ai")
+  }
+
+  ttl := DEFAULT_CACHE_TTL
+  if value := env.Get("CACHE_TTL"); value != "" {
+    d, err := time.ParseDuration(value)
+    if err != nil {
+      return nil, fmt.Errorf("invalid CACHE_TTL: %v", err)
+    }
+    ttl = d
+  }
+
+  var maxSize int64 = DEFAULT_CACHE_MAX_SIZE
+  if value := env.Get("CACHE_MAX_SIZE"); value != "" {
+    mb, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || mb <= 0 {
+      return nil, fmt.Errorf("invalid CACHE_MAX_SIZE: %s", value)
+    }
+    maxSize = mb * 1024 * 1024
+  }
+
+  return NewCache(dir, ttl, maxSize), nil
+}
+
+// CacheKey hashes all the parts into a single key, parts are separated so
+// ("ab", "c") and ("a", "bc") don't collide.
+func CacheKey(parts ...string) string {
+  hash := sha256.New()
+  for _, part := range parts {
+    hash.Write([]byte(strconv.Itoa(len(part))))
+    hash.Write([]byte(":"))
+    hash.Write([]byte(part))
+  }
+  return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *Cache) path(key string) string {
+  return filepath.Join(c.dir, key+".json")
+}
+
+func (c *Cache) Get(key string) (*AiResponse, bool) {
+  data, err := os.ReadFile(c.path(key))
+  if err != nil {
+    return nil, false
+  }
+
+  entry := &cacheEntry{}
+  if err := json.Unmarshal(data, entry); err != nil || entry.Response == nil {
+    os.Remove(c.path(key))
+    return nil, false
+  }
+
+  if time.Since(entry.CreatedAt) > c.ttl {
+    os.Remove(c.path(key))
+    return nil, false
+  }
+
+  return entry.Response, true
+}
+
+func (c *Cache) Put(key string, response *AiResponse) error {
+  if err := os.MkdirAll(c.dir, 0700); err != nil {
+    return fmt.Errorf("error creating cache directory: %v", err)
+  }
+
+  data, err := json.Marshal(&cacheEntry{
+    CreatedAt: time.Now(),
+    Response: response,
+  })
+  if err != nil {
+    return fmt.Errorf("error marshalling cache entry: %v", err)
+  }
+
+  if err := os.WriteFile(c.path(key), data, 0600); err != nil {
+    return fmt.Errorf("error writing cache entry: %v", err)
+  }
+
+  return c.prune()
+}
+
+// Clear removes all the cached responses.
+func (c *Cache) Clear() (int, error) {
+  files, err := c.files()
+  if err != nil {
+    return 0, err
+  }
+
+  for _, file := range files {
+    if err := os.Remove(file.path); err != nil {
+      return 0, fmt.Errorf("error removing cache entry: %v", err)
+    }
+  }
+
+  return len(files), nil
+}
+
+type cacheFile struct {
+  path string
+  size int64
+  modTime time.Time
+}
+
+func (c *Cache) files() ([]cacheFile, error) {
+  entries, err := os.ReadDir(c.dir)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("error reading cache directory: %v", err)
+  }
+
+  var files []cacheFile
+  for _, entry := range entries {
+    if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+      continue
+    }
+    info, err := entry.Info()
+    if err != nil {
+      continue
+    }
+    files = append(files, cacheFile{
+      path: filepath.Join(c.dir, entry.Name()),
+      size: info.Size(),
+      modTime: info.ModTime(),
+    })
+  }
+
+  return files, nil
+}
+
+// prune drops the expired entries and then the oldest ones until the cache
+// fits in maxSize.
+func (c *Cache) prune() error {
+  files, err := c.files()
+  if err != nil {
+    return err
+  }
+
+  sort.Slice(files, func(i, j int) bool {
+    return files[i].modTime.After(files[j].modTime)
+  })
+
+  var total int64
+  for _, file := range files {
+    total += file.size
+    if time.Since(file.modTime) > c.ttl || total > c.maxSize {
+      os.Remove(file.path)
+    }
+  }
+
+  return nil
+}
@@ -0,0 +1,77 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+)
+
+// A chat that keeps calling tools is most likely going in circles.
+const MAX_TOOL_ROUNDS = 10
+
+// Tool is a function the model can call in AskChatWithTools.
+type Tool struct {
+  Name string `json:"name"`
+  Description string `json:"description"`
+  InputSchema map[string]interface{} `json:"input_schema"`
+  // Run gets the input of the call and returns the result for the model. The
+  // error goes to the model too, it can fix the input and call again.
+  Run func(ctx context.Context, input map[string]interface{}) (string, error) `json:"-"`
+}
+
+// AskChatWithTools is AskChat with tools: the calls of the model are run and
+// their results sent back until it answers. It returns the answer and the
+// whole conversation, to continue it with the next question. With a stream
+// handler in the context (AskChatStream) every response is streamed.
+func (c *AnthropicClient) AskChatWithTools(ctx context.Context, messages []Message, tools []Tool) (*AiResponse, []Message, error) {
+  byName := make(map[string]Tool, len(tools))
+  for _, tool := range tools {
+    byName[tool.Name] = tool
+  }
+
+  for round := 0; round < MAX_TOOL_ROUNDS; round++ {
+    requestBody := c.chatRequest(messages)
+    if len(tools) > 0 {
+      requestBody["tools"] = tools
+    }
+
+    res, err := c.postWithRetry(ctx, requestBody, false)
+    if err != nil {
+      return nil, messages, err
+    }
+
+    // The calls have to go back with the text, the results refer to them.
+    blocks := append([]ContentBlock{}, res.Message.Content...)
+    for _, call := range res.ToolCalls {
+      blocks = append(blocks, ToolUseBlock(call))
+    }
+    messages = append(messages, NewMessage("assistant", blocks...))
+
+    if res.StopReason != "tool_use" || len(res.ToolCalls) == 0 {
+      return res, messages, nil
+    }
+
+    results := make([]ContentBlock, len(res.ToolCalls))
+    for i, call := range res.ToolCalls {
+      results[i] = runTool(ctx, byName, call)
+    }
+    messages = append(messages, NewMessage("user", results...))
+  }
+
+  return nil, messages, fmt.Errorf("no answer after %d rounds of tool calls", MAX_TOOL_ROUNDS)
+}
+
+func runTool(ctx context.Context, tools map[string]Tool, call ToolCall) ContentBlock {
+  tool, ok := tools[call.Name]
+  if !ok {
+    return ToolResultBlock(call.Id, fmt.Sprintf("unknown tool: %s", call.Name), true)
+  }
+
+  l.Print("Calling ", call.Name, " with ", call.Input)
+  result, err := tool.Run(ctx, call.Input)
+  if err != nil {
+    l.Warn().Err(err).Str("tool", call.Name).Msg("Tool call failed")
+    return ToolResultBlock(call.Id, err.Error(), true)
+  }
+
+  return ToolResultBlock(call.Id, result, false)
+}
@@ -0,0 +1,90 @@
+package ai_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/ai/anthropictest"
+)
+
+func TestAskChatWithToolsRunsTools(t *testing.T) {
+  client, server := newTestClient(t)
+  server.Enqueue(
+    anthropictest.ToolCall("toolu_1", "lookup", map[string]interface{}{"query": "OVH"}),
+    anthropictest.ToolCall("toolu_2", "missing", map[string]interface{}{}),
+    anthropictest.Text("123,00 zł"),
+  )
+
+  var queries []string
+  tools := []ai.Tool{{
+    Name: "lookup",
+    Description: "Looks up the invoices",
+    InputSchema: map[string]interface{}{"type": "object"},
+    Run: func(ctx context.Context, input map[string]interface{}) (string, error) {
+      query, _ := input["query"].(string)
+      queries = append(queries, query)
+      return "found", nil
+    },
+  }}
+
+  messages := []ai.Message{ai.NewTextMessage("user", "Ile zapłaciliśmy OVH?")}
+  res, conversation, err := client.AskChatWithTools(context.Background(), messages, tools)
+  if err != nil {
+    t.Fatalf("AskChatWithTools: %v", err)
+  }
+
+  if res.Message.Text() != "123,00 zł" {
+    t.Errorf("answer = %q", res.Message.Text())
+  }
+  if len(queries) != 1 || queries[0] != "OVH" {
+    t.Errorf("tool called with %v, want [OVH]", queries)
+  }
+  // question, call, result, call, error, answer
+  if len(conversation) != 6 {
+    t.Fatalf("got %d messages in the conversation, want 6", len(conversation))
+  }
+
+  requests := server.Requests()
+  if len(requests) != 3 {
+    t.Fatalf("got %d requests, want 3", len(requests))
+  }
+  if _, ok := requests[0].Body["tools"]; !ok {
+    t.Error("tools not sent")
+  }
+
+  results := conversation[2].Content
+  if len(results) != 1 || results[0].ToolUseId != "toolu_1" || results[0].Content != "found" {
+    t.Errorf("tool result = %+v", results)
+  }
+  unknown := conversation[4].Content
+  if len(unknown) != 1 || !unknown[0].IsError || !strings.Contains(unknown[0].Content, "unknown tool") {
+    t.Errorf("unknown tool result = %+v, want an error", unknown)
+  }
+}
+
+func TestAskChatWithToolsStopsGoingInCircles(t *testing.T) {
+  client, server := newTestClient(t)
+  for i := 0; i < ai.MAX_TOOL_ROUNDS; i++ {
+    server.Enqueue(anthropictest.ToolCall("toolu_1", "lookup", map[string]interface{}{}))
+  }
+
+  tools := []ai.Tool{{
+    Name: "lookup",
+    InputSchema: map[string]interface{}{"type": "object"},
+    Run: func(ctx context.Context, input map[string]interface{}) (string, error) {
+      return "", errors.New("no invoices")
+    },
+  }}
+
+  messages := []ai.Message{ai.NewTextMessage("user", "Ile zapłaciliśmy OVH?")}
+  _, _, err := client.AskChatWithTools(context.Background(), messages, tools)
+  if err == nil {
+    t.Fatal("expected an error after too many rounds")
+  }
+  if got := len(server.Requests()); got != ai.MAX_TOOL_ROUNDS {
+    t.Errorf("got %d requests, want %d", got, ai.MAX_TOOL_ROUNDS)
+  }
+}
@@ -0,0 +1,342 @@
+package ai
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/env"
+	"github.com/krol22/invoice_go_sort_sort/utils"
+)
+
+// All the defaults for talking with the API live here, everything else should
+// go through the Config.
+const (
+  DEFAULT_BASE_URL = "https://api.anthropic.com"
+  DEFAULT_VERSION = "2023-06-01"
+  // The first Sonnet reading PDFs, the scans go to the model as documents.
+  DEFAULT_MODEL = "claude-3-5-sonnet-20241022"
+  DEFAULT_MAX_TOKENS = 4096
+  // How many times the model gets asked before the output is given up on.
+  DEFAULT_MAX_ATTEMPTS = 3
+  // Retries of the rate limited and overloaded requests.
+  DEFAULT_MAX_RETRIES = 3
+  MAX_RETRY_DELAY = time.Minute
+  // Ceiling for the retry of a truncated response.
+  MAX_OUTPUT_TOKENS = 8192
+  // Needed for the document content blocks.
+  PDF_BETA = "pdfs-2024-09-25"
+  // Upper bound for a single request, so a hung connection can't block the
+  // whole run forever.
+  DEFAULT_TIMEOUT = 2 * time.Minute
+  // Batches take minutes to hours, no point in asking more often.
+  DEFAULT_BATCH_POLL_INTERVAL = 30 * time.Second
+  // Batched requests cost half of the regular price.
+  BATCH_DISCOUNT = 0.5
+  // A routed task goes to the next model when the score of the answer is
+  // below this.
+  DEFAULT_ESCALATION_THRESHOLD = 0.7
+)
+
+// USD per million tokens, override with ANTHROPIC_PRICES.
+var DEFAULT_PRICES = map[string]Price{
+  "claude-3-5-sonnet-20240620": {Input: 3, Output: 15},
+  "claude-3-5-sonnet-20241022": {Input: 3, Output: 15},
+  "claude-3-5-haiku-20241022": {Input: 0.8, Output: 4},
+  "claude-3-haiku-20240307": {Input: 0.25, Output: 1.25},
+  "claude-3-opus-20240229": {Input: 15, Output: 75},
+}
+
+type ModelSettings struct {
+  Model string `json:"model"`
+  MaxTokens int `json:"maxTokens"`
+  Temperature *float64 `json:"temperature,omitempty"`
+}
+
+type Config struct {
+  BaseUrl string `json:"baseUrl"`
+  Version string `json:"version"`
+  Timeout time.Duration `json:"timeout"`
+  Default ModelSettings `json:"default"`
+  Tasks map[string]ModelSettings `json:"tasks"`
+  Prices map[string]Price `json:"prices"`
+  // In USD, zero means no limit.
+  MonthlyBudget float64 `json:"monthlyBudget"`
+  MaxAttempts int `json:"maxAttempts"`
+  MaxRetries int `json:"maxRetries"`
+  BatchPollInterval time.Duration `json:"batchPollInterval"`
+  Routes map[string]Route `json:"routes"`
+  EscalationThreshold float64 `json:"escalationThreshold"`
+}
+
+func DefaultConfig() *Config {
+  prices := make(map[string]Price, len(DEFAULT_PRICES))
+  for model, price := range DEFAULT_PRICES {
+    prices[model] = price
+  }
+
+  return &Config{
+    BaseUrl: DEFAULT_BASE_URL,
+    Version: DEFAULT_VERSION,
+    Timeout: DEFAULT_TIMEOUT,
+    Default: ModelSettings{
+      Model: DEFAULT_MODEL,
+      MaxTokens: DEFAULT_MAX_TOKENS,
+    },
+    Tasks: map[string]ModelSettings{
+      // A single label, no need for the whole budget.
+      "classify_document": {MaxTokens: 256},
+    },
+    Prices: prices,
+    MaxAttempts: DEFAULT_MAX_ATTEMPTS,
+    MaxRetries: DEFAULT_MAX_RETRIES,
+    BatchPollInterval: DEFAULT_BATCH_POLL_INTERVAL,
+    Routes: map[string]Route{},
+    EscalationThreshold: DEFAULT_ESCALATION_THRESHOLD,
+  }
+}
+
+// LoadConfig applies the ANTHROPIC_* variables on top of the defaults.
+//
+// Per task settings are passed in ANTHROPIC_TASKS as a comma separated list of
+// "<task>.<setting>=<value>" pairs, e.g.
+// "analyze_invoice.model=claude-3-haiku-20240307,analyze_invoice.max_tokens=1024".
+//
+// ANTHROPIC_PRICES adds or replaces the prices in the same way, as
+// "<model>=<input>:<output>" pairs in USD per million tokens.
+//
+// ANTHROPIC_ROUTES sets the models a task escalates through, as
+// "<task>=<model>><model>" pairs, e.g.
+// "analyze_invoice=claude-3-5-haiku-20241022>claude-3-5-sonnet-20241022".
+// ANTHROPIC_ROUTE_COMPARE lists the "<task>.<field>" pairs the first two
+// models of the route have to agree on, both models are asked then.
+func LoadConfig() (*Config, error) {
+  return ConfigFromLookup(env.Get)
+}
+
+// ConfigFromLookup is LoadConfig with a custom source of the variables.
+func ConfigFromLookup(lookup func(key string) string) (*Config, error) {
+  config := DefaultConfig()
+
+  if baseUrl := lookup("ANTHROPIC_BASE_URL"); baseUrl != "" {
+    config.BaseUrl = strings.TrimSuffix(baseUrl, "/")
+  }
+
+  if version := lookup("ANTHROPIC_VERSION"); version != "" {
+    config.Version = version
+  }
+
+  if timeout := lookup("ANTHROPIC_TIMEOUT"); timeout != "" {
+    d, err := time.ParseDuration(timeout)
+    if err != nil {
+      return nil, fmt.Errorf("invalid ANTHROPIC_TIMEOUT: %v", err)
+    }
+    config.Timeout = d
+  }
+
+  settings := map[string]string{
+    "model": lookup("ANTHROPIC_MODEL"),
+    "max_tokens": lookup("ANTHROPIC_MAX_TOKENS"),
+    "temperature": lookup("ANTHROPIC_TEMPERATURE"),
+  }
+  for key, value := range settings {
+    if value == "" {
+      continue
+    }
+    if err := config.Default.set(key, value); err != nil {
+      return nil, err
+    }
+  }
+
+  if tasks := lookup("ANTHROPIC_TASKS"); tasks != "" {
+    for _, pair := range strings.Split(tasks, ",") {
+      pair = strings.TrimSpace(pair)
+      if pair == "" {
+        continue
+      }
+
+      key, value, ok := strings.Cut(pair, "=")
+      task, setting, hasTask := strings.Cut(key, ".")
+      if !ok || !hasTask {
+        return nil, fmt.Errorf("invalid ANTHROPIC_TASKS entry: %s", pair)
+      }
+
+      taskSettings := config.Tasks[task]
+      if err := taskSettings.set(setting, value); err != nil {
+        return nil, err
+      }
+      config.Tasks[task] = taskSettings
+    }
+  }
+
+  if prices := lookup("ANTHROPIC_PRICES"); prices != "" {
+    for _, pair := range strings.Split(prices, ",") {
+      pair = strings.TrimSpace(pair)
+      if pair == "" {
+        continue
+      }
+
+      model, value, ok := strings.Cut(pair, "=")
+      input, output, hasOutput := strings.Cut(value, ":")
+      if !ok || !hasOutput {
+        return nil, fmt.Errorf("invalid ANTHROPIC_PRICES entry: %s", pair)
+      }
+
+      inputPrice, inputErr := strconv.ParseFloat(input, 64)
+      outputPrice, outputErr := strconv.ParseFloat(output, 64)
+      if inputErr != nil || outputErr != nil {
+        return nil, fmt.Errorf("invalid ANTHROPIC_PRICES entry: %s", pair)
+      }
+
+      config.Prices[model] = Price{Input: inputPrice, Output: outputPrice}
+    }
+  }
+
+  if budget := lookup("AI_MONTHLY_BUDGET"); budget != "" {
+    value, err := strconv.ParseFloat(budget, 64)
+    if err != nil || value < 0 {
+      return nil, fmt.Errorf("invalid AI_MONTHLY_BUDGET: %s", budget)
+    }
+    config.MonthlyBudget = value
+  }
+
+  if maxAttempts := lookup("AI_MAX_ATTEMPTS"); maxAttempts != "" {
+    value, err := strconv.Atoi(maxAttempts)
+    if err != nil || value < 1 {
+      return nil, fmt.Errorf("invalid AI_MAX_ATTEMPTS: %s", maxAttempts)
+    }
+    config.MaxAttempts = value
+  }
+
+  if maxRetries := lookup("ANTHROPIC_MAX_RETRIES"); maxRetries != "" {
+    value, err := strconv.Atoi(maxRetries)
+    if err != nil || value < 0 {
+      return nil, fmt.Errorf("invalid ANTHROPIC_MAX_RETRIES: %s", maxRetries)
+    }
+    config.MaxRetries = value
+  }
+
+  if routes := lookup("ANTHROPIC_ROUTES"); routes != "" {
+    for _, pair := range strings.Split(routes, ",") {
+      pair = strings.TrimSpace(pair)
+      if pair == "" {
+        continue
+      }
+
+      task, models, ok := strings.Cut(pair, "=")
+      if !ok || models == "" {
+        return nil, fmt.Errorf("invalid ANTHROPIC_ROUTES entry: %s", pair)
+      }
+
+      route := config.Routes[task]
+      route.Models = nil
+      for _, model := range strings.Split(models, ">") {
+        if model = strings.TrimSpace(model); model != "" {
+          route.Models = append(route.Models, model)
+        }
+      }
+      config.Routes[task] = route
+    }
+  }
+
+  if compare := lookup("ANTHROPIC_ROUTE_COMPARE"); compare != "" {
+    for _, pair := range strings.Split(compare, ",") {
+      pair = strings.TrimSpace(pair)
+      if pair == "" {
+        continue
+      }
+
+      task, field, ok := strings.Cut(pair, ".")
+      route, hasRoute := config.Routes[task]
+      if !ok || !hasRoute || len(route.Models) < 2 {
+        return nil, fmt.Errorf("invalid ANTHROPIC_ROUTE_COMPARE entry, the task needs a route with two models: %s", pair)
+      }
+
+      route.Compare = append(route.Compare, field)
+      config.Routes[task] = route
+    }
+  }
+
+  if threshold := lookup("AI_ESCALATION_THRESHOLD"); threshold != "" {
+    value, err := strconv.ParseFloat(threshold, 64)
+    if err != nil || value < 0 || value > 1 {
+      return nil, fmt.Errorf("invalid AI_ESCALATION_THRESHOLD: %s", threshold)
+    }
+    config.EscalationThreshold = value
+  }
+
+  if pollInterval := lookup("ANTHROPIC_BATCH_POLL_INTERVAL"); pollInterval != "" {
+    d, err := time.ParseDuration(pollInterval)
+    if err != nil || d <= 0 {
+      return nil, fmt.Errorf("invalid ANTHROPIC_BATCH_POLL_INTERVAL: %s", pollInterval)
+    }
+    config.BatchPollInterval = d
+  }
+
+  return config, nil
+}
+
+func (s *ModelSettings) set(key string, value string) error {
+  value = strings.TrimSpace(value)
+
+  switch key {
+  case "model":
+    s.Model = value
+  case "max_tokens":
+    maxTokens, err := strconv.Atoi(value)
+    if err != nil || maxTokens <= 0 {
+      return fmt.Errorf("invalid max_tokens: %s", value)
+    }
+    s.MaxTokens = maxTokens
+  case "temperature":
+    temperature, err := strconv.ParseFloat(value, 64)
+    if err != nil || temperature < 0 || temperature > 1 {
+      return fmt.Errorf("invalid temperature: %s", value)
+    }
+    s.Temperature = &temperature
+  default:
+    return fmt.Errorf("unknown model setting: %s", key)
+  }
+
+  return nil
+}
+
+// ForTask returns the settings of the given task, falling back to the
+// defaults for everything the task doesn't override.
+func (c *Config) ForTask(name string) ModelSettings {
+  settings := c.Default
+
+  override, ok := c.Tasks[name]
+  if !ok {
+    return settings
+  }
+
+  if override.Model != "" {
+    settings.Model = override.Model
+  }
+  if override.MaxTokens != 0 {
+    settings.MaxTokens = override.MaxTokens
+  }
+  if override.Temperature != nil {
+    settings.Temperature = override.Temperature
+  }
+
+  return settings
+}
+
+func (c *Config) Log() {
+  l.Print("Using AI settings: ", utils.PrettyPrint(map[string]interface{}{
+    "baseUrl": c.BaseUrl,
+    "version": c.Version,
+    "timeout": c.Timeout.String(),
+    "default": c.Default,
+    "tasks": c.Tasks,
+    "monthlyBudget": c.MonthlyBudget,
+    "maxAttempts": c.MaxAttempts,
+    "maxRetries": c.MaxRetries,
+    "batchPollInterval": c.BatchPollInterval.String(),
+    "routes": c.Routes,
+    "escalationThreshold": c.EscalationThreshold,
+  }))
+}
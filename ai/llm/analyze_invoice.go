@@ -2,12 +2,64 @@ package llm
 
 import (
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/krol22/invoice_go_sort_sort/ai"
 )
 
+const ANALYZE_INVOICE = "analyze_invoice"
+
+// An invoice received by email is rarely older than a year, and can't be
+// dated much after it was received.
+const (
+  MAX_INVOICE_AGE = 365 * 24 * time.Hour
+  MAX_INVOICE_DATE_AFTER_RECEIVED = 7 * 24 * time.Hour
+)
+
 type AnalyzeInvoiceLLMInput struct {
   Invoice string
+  // The original PDF, sent to the model when the text layer is missing.
+  Document []byte
+  // The scan of an invoice attached as an image, sent instead of the PDF.
+  Images []InvoiceImage
+  // When the email with the invoice was received, used to sanity check the
+  // extracted date.
+  ReceivedAt time.Time
+  // The email the invoice came with, if any.
+  Email *EmailContext
+  // 1-based, set when a long invoice is analysed in parts, see PlanDocument.
+  // A part may have neither the date nor the totals.
+  Part int
+  Parts int
+  // Some of the text was read by OCR from a scan, see pdf.Read.
+  OCR bool
+}
+
+func (i *AnalyzeInvoiceLLMInput) IsPart() bool {
+  return i.Parts > 1
+}
+
+// EmailContext is what the email says about the invoice: the subject, the
+// sender and the body often name the vendor or the billing period.
+type EmailContext struct {
+  Subject string
+  From string
+  // Trimmed to what the sender wrote, see email.TrimBody.
+  Body string
+}
+
+// HasDocument tells the prompt whether the invoice is attached instead of
+// pasted as text.
+func (i *AnalyzeInvoiceLLMInput) HasDocument() bool {
+  return len(i.Document) > 0 || len(i.Images) > 0
+}
+
+// InvoiceImage is a scan or a photo of the invoice, the media type is one of
+// those ai.ImageBlock takes.
+type InvoiceImage struct {
+  MediaType string
+  Content []byte
 }
 
 type AnalyzeInvoiceLLMOutputSchema struct {
@@ -16,6 +68,9 @@ type AnalyzeInvoiceLLMOutputSchema struct {
 
 type AnalyzeInvoiceLLMOutputResponse struct {
   InvoiceDate string `json:"invoiceDate"`
+  NetTotal *float64 `json:"netTotal,omitempty"`
+  VatTotal *float64 `json:"vatTotal,omitempty"`
+  GrossTotal *float64 `json:"grossTotal,omitempty"`
 }
 
 type AnalyzeInvoiceLLM struct {
@@ -29,49 +84,242 @@ func (b *AnalyzeInvoiceLLM) GenerateChat() ([]ai.Message, error) {
     return nil, fmt.Errorf("invalid input data")
   }
 
-  messages := []ai.Message{
-    {
-      Role:    "user",
-      Content: `
-        You're a specialist in analysing the invoices and you're given a task of extracing the creation date of the invoice.  
-      `,
-    },
-    {
-      Role:    "user",
-      Content: `
-        Analyze the following invoice:
-        <invoice>
-        ` + 
-        input.Invoice + `
-        </invoice>
-
-        Return the date in the following format 'YYYY-MM-DD'
-        `,
-    },
+  attachments := []ai.ContentBlock{}
+  if len(input.Document) > 0 {
+    attachments = append(attachments, ai.DocumentBlock(input.Document))
   }
+  for _, image := range input.Images {
+    attachments = append(attachments, ai.ImageBlock(image.MediaType, image.Content))
+  }
+
+  return b.promptMessages(ANALYZE_INVOICE, input, attachments...)
+}
 
-  return messages, nil
+func (b *AnalyzeInvoiceLLM) GetName() string {
+  return ANALYZE_INVOICE
+}
+
+func (b *AnalyzeInvoiceLLM) GetPromptVersion() string {
+  return b.promptVersion(ANALYZE_INVOICE)
 }
 
 func (b *AnalyzeInvoiceLLM) GetOutputSchema() map[string]interface{} {
+  date := map[string]interface{} {
+    "type": "string",
+    "description": "The creation date of the invoice",
+  }
+  if input, ok := b.inputData.(*AnalyzeInvoiceLLMInput); ok && input.IsPart() {
+    date["description"] = "The creation date of the invoice, skip if it's not in this part"
+    date["required"] = false
+  }
+
   return map[string]interface{}{
-    "date": map[string]interface{} {
-      "type": "string",
-      "description": "The creation date of the invoice",
+    "date": date,
+    "netTotal": map[string]interface{} {
+      "type": "number",
+      "description": "The total net amount, skip if not present",
+      "required": false,
+    },
+    "vatTotal": map[string]interface{} {
+      "type": "number",
+      "description": "The total VAT amount, skip if not present",
+      "required": false,
+    },
+    "grossTotal": map[string]interface{} {
+      "type": "number",
+      "description": "The total gross amount to pay, skip if not present",
+      "required": false,
+    },
+    "dateConfidence": map[string]interface{} {
+      "type": "number",
+      "description": "How confident you are about the date, from 0 to 1",
+    },
+    "totalsConfidence": map[string]interface{} {
+      "type": "number",
+      "description": "How confident you are about the totals, from 0 to 1, skip if there are no totals",
+      "required": false,
     },
   }
 }
 
 func (b *AnalyzeInvoiceLLM) GetOutput() *AnalyzeInvoiceLLMOutputResponse {
-  return &AnalyzeInvoiceLLMOutputResponse{
-    InvoiceDate: b.aiResponse.JsonOutput["date"].(string),
+  output := &AnalyzeInvoiceLLMOutputResponse{}
+  if b.aiResponse == nil {
+    return output
   }
+
+  jsonOutput := b.aiResponse.JsonOutput
+  output.InvoiceDate, _ = jsonOutput["date"].(string)
+  output.NetTotal = optionalNumber(jsonOutput, "netTotal")
+  output.VatTotal = optionalNumber(jsonOutput, "vatTotal")
+  output.GrossTotal = optionalNumber(jsonOutput, "grossTotal")
+
+  return output
+}
+
+// Confidence scores the date and, if present, the totals. Call it after a
+// successful RunLLM.
+func (b *AnalyzeInvoiceLLM) Confidence() map[string]FieldConfidence {
+  confidence := map[string]FieldConfidence{}
+  if b.aiResponse == nil {
+    return confidence
+  }
+
+  jsonOutput := b.aiResponse.JsonOutput
+  input, _ := b.inputData.(*AnalyzeInvoiceLLMInput)
+  text := ""
+  ocr := false
+  if input != nil {
+    text = input.Invoice
+    ocr = input.OCR
+  }
+
+  dateModel, _ := jsonOutput["dateConfidence"].(float64)
+  dateHeuristic := HEURISTIC_NOT_FOUND
+  if date, err := parseDateField(jsonOutput, "date"); err == nil {
+    dateHeuristic = dateInText(text, date)
+  }
+  if ocr {
+    dateHeuristic = math.Min(dateHeuristic, HEURISTIC_OCR)
+  }
+  confidence["date"] = newFieldConfidence(dateModel, dateHeuristic)
+
+  output := b.GetOutput()
+  if output.NetTotal != nil || output.VatTotal != nil || output.GrossTotal != nil {
+    totalsModel, ok := jsonOutput["totalsConfidence"].(float64)
+    if !ok {
+      totalsModel = dateModel
+    }
+
+    totalsHeuristic := HEURISTIC_UNKNOWN
+    if output.NetTotal != nil && output.VatTotal != nil && output.GrossTotal != nil {
+      // The validators already made sure they add up.
+      totalsHeuristic = HEURISTIC_CONFIRMED
+    }
+    if ocr {
+      totalsHeuristic = math.Min(totalsHeuristic, HEURISTIC_OCR)
+    }
+    confidence["totals"] = newFieldConfidence(totalsModel, totalsHeuristic)
+  }
+
+  return confidence
+}
+
+// Score is the confidence of the date, the only field that decides where the
+// invoice goes. It's what the routing escalates on.
+func (b *AnalyzeInvoiceLLM) Score() float64 {
+  return b.Confidence()["date"].Score
+}
+
+func optionalNumber(output map[string]interface{}, field string) *float64 {
+  value, ok := output[field].(float64)
+  if !ok {
+    return nil
+  }
+  return &value
 }
 
 func NewAnalyzeInvoiceLLM(inputData interface{}) *AnalyzeInvoiceLLM {
+  var receivedAt time.Time
+  var text string
+  part := false
+  if input, ok := inputData.(*AnalyzeInvoiceLLMInput); ok {
+    receivedAt = input.ReceivedAt
+    // The PDF has the text too, but we can't check against it.
+    if !input.HasDocument() {
+      text = input.Invoice
+    }
+    part = input.IsPart()
+  }
+
+  validators := append(invoiceDateValidators(receivedAt), DateInText("date", text))
+  if part {
+    for i, validator := range validators {
+      validators[i] = IfPresent("date", validator)
+    }
+  }
+
   return &AnalyzeInvoiceLLM{
     BaseLLM: BaseLLM{
       inputData: inputData,
+      validators: append(validators, TotalsConsistent("netTotal", "vatTotal", "grossTotal")),
     },
   }
 }
+
+// MergeAnalyses puts together the analyses of the parts of a long invoice:
+// the date and the totals each come from the part most confident about them,
+// the earliest part for the date and the latest for the totals on a tie. The
+// result is checked against the whole invoice, a ValidationError when it
+// doesn't pass.
+func MergeAnalyses(input *AnalyzeInvoiceLLMInput, parts []*AnalyzeInvoiceLLM) (*AnalyzeInvoiceLLM, error) {
+  var dateFrom, totalsFrom *ai.AiResponse
+  dateConfidence, totalsConfidence := -1.0, -1.0
+
+  for _, part := range parts {
+    res := part.GetAiResponse()
+    if res == nil || res.JsonOutput == nil {
+      continue
+    }
+    output := res.JsonOutput
+
+    if date, _ := output["date"].(string); date != "" {
+      confidence, _ := output["dateConfidence"].(float64)
+      if confidence > dateConfidence {
+        dateFrom, dateConfidence = res, confidence
+      }
+    }
+
+    if _, ok := output["grossTotal"].(float64); ok {
+      confidence, ok := output["totalsConfidence"].(float64)
+      if !ok {
+        confidence, _ = output["dateConfidence"].(float64)
+      }
+      if confidence >= totalsConfidence {
+        totalsFrom, totalsConfidence = res, confidence
+      }
+    }
+  }
+
+  merged := NewAnalyzeInvoiceLLM(input)
+  res := &ai.AiResponse{JsonOutput: map[string]interface{}{}}
+  if dateFrom != nil {
+    res.Model = dateFrom.Model
+    res.PromptVersion = dateFrom.PromptVersion
+    for _, field := range []string{"date", "dateConfidence"} {
+      res.JsonOutput[field] = dateFrom.JsonOutput[field]
+    }
+  }
+  if totalsFrom != nil {
+    for _, field := range []string{"netTotal", "vatTotal", "grossTotal", "totalsConfidence"} {
+      if value, ok := totalsFrom.JsonOutput[field]; ok {
+        res.JsonOutput[field] = value
+      }
+    }
+  }
+  merged.SetAiResponse(res)
+
+  if err := merged.Validate(); err != nil {
+    return merged, &ai.ValidationError{
+      Attempts: len(parts),
+      Output: res.JsonOutput,
+      PromptVersion: merged.GetPromptVersion(),
+      Err: err,
+    }
+  }
+  return merged, nil
+}
+
+func invoiceDateValidators(receivedAt time.Time) []Validator {
+  return []Validator{
+    DateParses("date"),
+    DateNotInFuture("date", time.Now),
+    DateNear("date", receivedAt, MAX_INVOICE_AGE, MAX_INVOICE_DATE_AFTER_RECEIVED),
+  }
+}
+
+// ValidateInvoiceDate runs the same date checks as the task, for dates found
+// without the model.
+func ValidateInvoiceDate(date string, receivedAt time.Time) error {
+  return runValidators(map[string]interface{}{"date": date}, invoiceDateValidators(receivedAt))
+}
@@ -0,0 +1,84 @@
+package llm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+)
+
+func TestMergeAnalyses(t *testing.T) {
+  cases := []struct {
+    name string
+    outputs []map[string]interface{}
+    date string
+    grossTotal float64
+  }{
+    {
+      name: "most confident date",
+      outputs: []map[string]interface{}{
+        {"date": "2024-03-01", "dateConfidence": 0.5},
+        {"date": "2024-03-15", "dateConfidence": 0.9},
+      },
+      date: "2024-03-15",
+    },
+    {
+      name: "earliest date on a tie",
+      outputs: []map[string]interface{}{
+        {"date": "2024-03-01", "dateConfidence": 0.9},
+        {"date": "2024-03-15", "dateConfidence": 0.9},
+      },
+      date: "2024-03-01",
+    },
+    {
+      name: "latest totals on a tie",
+      outputs: []map[string]interface{}{
+        {"date": "2024-03-15", "dateConfidence": 0.9, "grossTotal": 100.0, "totalsConfidence": 0.8},
+        nil,
+        {"grossTotal": 123.0, "totalsConfidence": 0.8},
+      },
+      date: "2024-03-15",
+      grossTotal: 123,
+    },
+    {
+      name: "totals confidence from the date",
+      outputs: []map[string]interface{}{
+        {"date": "2024-03-15", "dateConfidence": 0.9, "grossTotal": 100.0},
+        {"grossTotal": 123.0, "totalsConfidence": 0.5},
+      },
+      date: "2024-03-15",
+      grossTotal: 100,
+    },
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      input := &AnalyzeInvoiceLLMInput{
+        Invoice: "Data sprzedaży: 2024-03-01\nData wystawienia: 2024-03-15",
+        ReceivedAt: time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC),
+        Parts: len(c.outputs),
+      }
+      parts := make([]*AnalyzeInvoiceLLM, len(c.outputs))
+      for i, output := range c.outputs {
+        partInput := *input
+        partInput.Part = i + 1
+        parts[i] = NewAnalyzeInvoiceLLM(&partInput)
+        if output != nil {
+          parts[i].SetAiResponse(&ai.AiResponse{JsonOutput: output})
+        }
+      }
+
+      merged, err := MergeAnalyses(input, parts)
+      if err != nil {
+        t.Fatalf("MergeAnalyses: %v", err)
+      }
+      output := merged.GetAiResponse().JsonOutput
+      if date, _ := output["date"].(string); date != c.date {
+        t.Errorf("date = %q, want %q", date, c.date)
+      }
+      if grossTotal, _ := output["grossTotal"].(float64); grossTotal != c.grossTotal {
+        t.Errorf("grossTotal = %v, want %v", grossTotal, c.grossTotal)
+      }
+    })
+  }
+}
@@ -0,0 +1,22 @@
+package llm
+
+const ASK_INVOICES = "ask_invoices"
+
+type AskInvoicesInput struct {
+  // YYYY-MM-DD, for the questions like "last month".
+  Today string
+  Documents int
+  Labels []DocumentLabel
+}
+
+// AskInvoicesPrompt renders the system prompt of the ask command. It's a chat,
+// the questions go to the model as the user wrote them.
+func AskInvoicesPrompt(input *AskInvoicesInput) (string, error) {
+  prompt, err := LoadPrompt(ASK_INVOICES)
+  if err != nil {
+    return "", err
+  }
+
+  system, _, err := prompt.Render(input)
+  return system, err
+}
@@ -5,10 +5,59 @@ import "github.com/krol22/invoice_go_sort_sort/ai"
 type BaseLLM struct {
   inputData interface{}
   aiResponse *ai.AiResponse
+  validators []Validator
+  prompt *Prompt
 }
 
-func (b *BaseLLM) GetMaxTokens() int {
-  return 4096
+func (b *BaseLLM) loadPrompt(name string) (*Prompt, error) {
+  if b.prompt != nil {
+    return b.prompt, nil
+  }
+
+  prompt, err := LoadPrompt(name)
+  if err != nil {
+    return nil, err
+  }
+  b.prompt = prompt
+
+  return prompt, nil
+}
+
+// promptVersion is empty when the prompt can't be loaded, GenerateChat
+// reports the error then.
+func (b *BaseLLM) promptVersion(name string) string {
+  prompt, err := b.loadPrompt(name)
+  if err != nil {
+    return ""
+  }
+  return prompt.Version
+}
+
+// promptMessages renders the prompt into the system message and the user
+// message, which also carries the attachments.
+func (b *BaseLLM) promptMessages(name string, input interface{}, attachments ...ai.ContentBlock) ([]ai.Message, error) {
+  prompt, err := b.loadPrompt(name)
+  if err != nil {
+    return nil, err
+  }
+
+  system, user, err := prompt.Render(input)
+  if err != nil {
+    return nil, err
+  }
+
+  blocks := append(attachments, ai.TextBlock(user))
+  return []ai.Message{
+    ai.NewTextMessage("system", system),
+    ai.NewMessage("user", blocks...),
+  }, nil
+}
+
+func (b *BaseLLM) Validate() error {
+  if b.aiResponse == nil {
+    return runValidators(nil, b.validators)
+  }
+  return runValidators(b.aiResponse.JsonOutput, b.validators)
 }
 
 func (b *BaseLLM) SetAiResponse(aiResponse *ai.AiResponse) {
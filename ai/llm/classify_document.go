@@ -0,0 +1,119 @@
+package llm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+)
+
+const CLASSIFY_DOCUMENT = "classify_document"
+
+type DocumentLabel string
+
+const (
+  LABEL_VAT_INVOICE DocumentLabel = "vat_invoice"
+  LABEL_CORRECTION_INVOICE DocumentLabel = "correction_invoice"
+  LABEL_PROFORMA DocumentLabel = "proforma"
+  LABEL_RECEIPT DocumentLabel = "receipt"
+  LABEL_BILL DocumentLabel = "bill"
+  // Terms of service, delivery notes, price lists and everything else we
+  // don't file.
+  LABEL_OTHER DocumentLabel = "other"
+)
+
+var DocumentLabels = []DocumentLabel{
+  LABEL_VAT_INVOICE,
+  LABEL_CORRECTION_INVOICE,
+  LABEL_PROFORMA,
+  LABEL_RECEIPT,
+  LABEL_BILL,
+  LABEL_OTHER,
+}
+
+func documentLabels() []string {
+  labels := make([]string, len(DocumentLabels))
+  for i, label := range DocumentLabels {
+    labels[i] = string(label)
+  }
+  return labels
+}
+
+type ClassifyDocumentLLMInput struct {
+  Filename string
+  Document string
+  // The original PDF, sent to the model when the text layer is missing.
+  Pdf []byte
+  // The scan attached as an image, sent instead of the PDF.
+  Images []InvoiceImage
+}
+
+func (i *ClassifyDocumentLLMInput) HasDocument() bool {
+  return len(i.Pdf) > 0 || len(i.Images) > 0
+}
+
+type ClassifyDocumentLLMOutputResponse struct {
+  Label DocumentLabel `json:"label"`
+}
+
+type ClassifyDocumentLLM struct {
+  BaseLLM
+}
+
+func (b *ClassifyDocumentLLM) GenerateChat() ([]ai.Message, error) {
+  input, ok := b.inputData.(*ClassifyDocumentLLMInput)
+
+  if !ok {
+    return nil, fmt.Errorf("invalid input data")
+  }
+
+  attachments := []ai.ContentBlock{}
+  if len(input.Pdf) > 0 {
+    attachments = append(attachments, ai.DocumentBlock(input.Pdf))
+  }
+  for _, image := range input.Images {
+    attachments = append(attachments, ai.ImageBlock(image.MediaType, image.Content))
+  }
+
+  return b.promptMessages(CLASSIFY_DOCUMENT, input, attachments...)
+}
+
+func (b *ClassifyDocumentLLM) GetName() string {
+  return CLASSIFY_DOCUMENT
+}
+
+func (b *ClassifyDocumentLLM) GetPromptVersion() string {
+  return b.promptVersion(CLASSIFY_DOCUMENT)
+}
+
+func (b *ClassifyDocumentLLM) GetOutputSchema() map[string]interface{} {
+  return map[string]interface{}{
+    "label": map[string]interface{} {
+      "type": "string",
+      "description": "The kind of the document, one of: " + strings.Join(documentLabels(), ", "),
+    },
+  }
+}
+
+func (b *ClassifyDocumentLLM) GetOutput() *ClassifyDocumentLLMOutputResponse {
+  output := &ClassifyDocumentLLMOutputResponse{}
+  if b.aiResponse == nil {
+    return output
+  }
+
+  label, _ := b.aiResponse.JsonOutput["label"].(string)
+  output.Label = DocumentLabel(label)
+
+  return output
+}
+
+func NewClassifyDocumentLLM(inputData interface{}) *ClassifyDocumentLLM {
+  return &ClassifyDocumentLLM{
+    BaseLLM: BaseLLM{
+      inputData: inputData,
+      validators: []Validator{
+        OneOf("label", documentLabels()...),
+      },
+    },
+  }
+}
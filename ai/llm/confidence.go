@@ -0,0 +1,76 @@
+package llm
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/dates"
+)
+
+// FieldConfidence combines what the model says about its answer with our own
+// checks of it. All values are between 0 and 1.
+type FieldConfidence struct {
+  Model float64 `json:"model"`
+  Heuristic float64 `json:"heuristic"`
+  Score float64 `json:"score"`
+}
+
+func newFieldConfidence(model float64, heuristic float64) FieldConfidence {
+  model = math.Max(0, math.Min(1, model))
+  return FieldConfidence{
+    Model: model,
+    Heuristic: heuristic,
+    Score: math.Min(model, heuristic),
+  }
+}
+
+// Heuristic scores for the checks we can do against the document.
+const (
+  HEURISTIC_CONFIRMED = 1.0
+  // At most, for the text read by OCR: the model may have repeated a misread
+  // digit that's in the text.
+  HEURISTIC_OCR = 0.8
+  // Nothing to check against, e.g. only the PDF was sent.
+  HEURISTIC_UNKNOWN = 0.6
+  HEURISTIC_NOT_FOUND = 0.3
+)
+
+var dateLayouts = []string{
+  "2006-01-02",
+  "02.01.2006",
+  "02-01-2006",
+  "02/01/2006",
+  "2006.01.02",
+  "2006/01/02",
+  "2.01.2006",
+}
+
+// dateInText checks whether the date is written in the text.
+func dateInText(text string, date time.Time) float64 {
+  if strings.TrimSpace(text) == "" {
+    return HEURISTIC_UNKNOWN
+  }
+
+  if textHasDate(text, date) {
+    return HEURISTIC_CONFIRMED
+  }
+  return HEURISTIC_NOT_FOUND
+}
+
+// textHasDate looks for the date in the common numeric formats, and in all
+// the formats the dates package understands, month names included.
+func textHasDate(text string, date time.Time) bool {
+  for _, layout := range dateLayouts {
+    if strings.Contains(text, date.Format(layout)) {
+      return true
+    }
+  }
+
+  for _, found := range dates.All(text) {
+    if found.Equal(date) {
+      return true
+    }
+  }
+  return false
+}
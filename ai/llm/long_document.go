@@ -0,0 +1,214 @@
+package llm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/env"
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+)
+
+// What to do with a text over the limit.
+const (
+  // Sent whole, it fits.
+  STRATEGY_FULL = "full"
+  // The first pages and the last one: the date is at the top, the totals at
+  // the bottom, and the middle is the itemised calls nobody needs.
+  STRATEGY_TRUNCATE = "truncate"
+  // Every part analysed on its own, the answers merged.
+  STRATEGY_CHUNK = "chunk"
+)
+
+// About 60 000 characters, a few pages of an invoice fit many times over.
+const DEFAULT_MAX_DOCUMENT_TOKENS = 20000
+
+type LongDocumentSettings struct {
+  MaxTokens int
+  Strategy string
+}
+
+// LoadLongDocumentSettings reads AI_MAX_DOCUMENT_TOKENS and
+// AI_LONG_DOCUMENT_STRATEGY (truncate or chunk).
+func LoadLongDocumentSettings() (LongDocumentSettings, error) {
+  settings := LongDocumentSettings{
+    MaxTokens: DEFAULT_MAX_DOCUMENT_TOKENS,
+    Strategy: STRATEGY_TRUNCATE,
+  }
+
+  if maxTokens := env.Get("AI_MAX_DOCUMENT_TOKENS"); maxTokens != "" {
+    value, err := strconv.Atoi(maxTokens)
+    // Less than a page makes no sense.
+    if err != nil || value < 500 {
+      return settings, fmt.Errorf("invalid AI_MAX_DOCUMENT_TOKENS: %s", maxTokens)
+    }
+    settings.MaxTokens = value
+  }
+
+  if strategy := env.Get("AI_LONG_DOCUMENT_STRATEGY"); strategy != "" {
+    if strategy != STRATEGY_TRUNCATE && strategy != STRATEGY_CHUNK {
+      return settings, fmt.Errorf("invalid AI_LONG_DOCUMENT_STRATEGY, use %s or %s: %s", STRATEGY_TRUNCATE, STRATEGY_CHUNK, strategy)
+    }
+    settings.Strategy = strategy
+  }
+
+  return settings, nil
+}
+
+// PageRange is 1-based and inclusive.
+type PageRange struct {
+  First int `json:"first"`
+  Last int `json:"last"`
+}
+
+func (r PageRange) String() string {
+  if r.First == r.Last {
+    return strconv.Itoa(r.First)
+  }
+  return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// DocumentStrategy is how the text of a document was sent to the model.
+type DocumentStrategy struct {
+  Name string `json:"name"`
+  Pages int `json:"pages"`
+  EstimatedTokens int `json:"estimatedTokens"`
+  // The pages sent. With chunking every range went in its own request.
+  Sent []PageRange `json:"sent"`
+}
+
+func (s *DocumentStrategy) String() string {
+  sent := make([]string, len(s.Sent))
+  for i, pages := range s.Sent {
+    sent[i] = pages.String()
+  }
+  return fmt.Sprintf("%s: %d pages, ~%d tokens, sent pages %s", s.Name, s.Pages, s.EstimatedTokens, strings.Join(sent, ", "))
+}
+
+// PlanDocument decides how to send the text of the document, see
+// pdf.Document.TextPages, and returns the texts to send, one per request.
+// Only the text is planned, a document sent as a PDF goes whole.
+func PlanDocument(pages []string, settings LongDocumentSettings) (*DocumentStrategy, []string) {
+  text := strings.Join(pages, pdf.PAGE_BREAK)
+  strategy := &DocumentStrategy{
+    Name: STRATEGY_FULL,
+    Pages: len(pages),
+    EstimatedTokens: ai.EstimateTokens(text),
+    Sent: []PageRange{{First: 1, Last: len(pages)}},
+  }
+
+  if strategy.EstimatedTokens <= settings.MaxTokens {
+    return strategy, []string{text}
+  }
+
+  strategy.Name = settings.Strategy
+  if settings.Strategy == STRATEGY_CHUNK {
+    var parts []string
+    parts, strategy.Sent = chunkPages(pages, settings.MaxTokens)
+    return strategy, parts
+  }
+
+  var truncated string
+  truncated, strategy.Sent = truncatePages(pages, settings.MaxTokens)
+  return strategy, []string{truncated}
+}
+
+// truncatePages keeps as many of the first pages as fit next to the last one,
+// with a note about the omitted ones in between.
+func truncatePages(pages []string, maxTokens int) (string, []PageRange) {
+  if len(pages) == 1 {
+    return cutStart(pages[0], maxTokens), []PageRange{{First: 1, Last: 1}}
+  }
+
+  n := len(pages)
+  // The totals are at the bottom of the last page.
+  last := cutEnd(pages[n - 1], maxTokens / 2)
+  budget := maxTokens - ai.EstimateTokens(last)
+
+  kept := []string{}
+  used := 0
+  for i := 0; i < n - 1; i++ {
+    tokens := ai.EstimateTokens(pages[i])
+    if used + tokens > budget {
+      break
+    }
+    kept = append(kept, pages[i])
+    used += tokens
+  }
+  if len(kept) == 0 {
+    kept = append(kept, cutStart(pages[0], budget))
+  }
+
+  ranges := []PageRange{{First: 1, Last: len(kept)}}
+  if len(kept) < n - 1 {
+    kept = append(kept, fmt.Sprintf("[pages %d-%d omitted]", len(kept) + 1, n - 1))
+  }
+  kept = append(kept, last)
+  ranges = append(ranges, PageRange{First: n, Last: n})
+
+  return strings.Join(kept, pdf.PAGE_BREAK), ranges
+}
+
+// chunkPages groups the pages into parts under the limit. A page over the
+// limit is cut into parts of its own.
+func chunkPages(pages []string, maxTokens int) ([]string, []PageRange) {
+  var parts []string
+  var ranges []PageRange
+
+  current := []string{}
+  first, used := 0, 0
+  flush := func(last int) {
+    if len(current) == 0 {
+      return
+    }
+    parts = append(parts, strings.Join(current, pdf.PAGE_BREAK))
+    ranges = append(ranges, PageRange{First: first + 1, Last: last})
+    current = []string{}
+    used = 0
+  }
+
+  for i, page := range pages {
+    tokens := ai.EstimateTokens(page)
+
+    if tokens > maxTokens {
+      flush(i)
+      runes := []rune(page)
+      size := maxTokens * ai.CHARS_PER_TOKEN
+      for start := 0; start < len(runes); start += size {
+        parts = append(parts, string(runes[start:min(start + size, len(runes))]))
+        ranges = append(ranges, PageRange{First: i + 1, Last: i + 1})
+      }
+      first = i + 1
+      continue
+    }
+
+    if used + tokens > maxTokens {
+      flush(i)
+    }
+    if len(current) == 0 {
+      first = i
+    }
+    current = append(current, page)
+    used += tokens
+  }
+  flush(len(pages))
+
+  return parts, ranges
+}
+
+func cutStart(text string, maxTokens int) string {
+  runes := []rune(text)
+  if limit := maxTokens * ai.CHARS_PER_TOKEN; len(runes) > limit {
+    return string(runes[:limit])
+  }
+  return text
+}
+
+func cutEnd(text string, maxTokens int) string {
+  runes := []rune(text)
+  if limit := maxTokens * ai.CHARS_PER_TOKEN; len(runes) > limit {
+    return string(runes[len(runes) - limit:])
+  }
+  return text
+}
@@ -0,0 +1,100 @@
+package llm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+)
+
+func TestPlanDocument(t *testing.T) {
+  // 10 tokens are 30 characters.
+  a, b, c := strings.Repeat("a", 15), strings.Repeat("b", 15), strings.Repeat("c", 15)
+  cases := []struct {
+    name string
+    pages []string
+    strategy string
+    want string
+    parts []string
+    sent []PageRange
+  }{
+    {
+      name: "fits",
+      pages: []string{"abc", "def"},
+      strategy: STRATEGY_TRUNCATE,
+      want: STRATEGY_FULL,
+      parts: []string{"abc" + pdf.PAGE_BREAK + "def"},
+      sent: []PageRange{{1, 2}},
+    },
+    {
+      name: "single page over the limit truncated",
+      pages: []string{strings.Repeat("a", 40)},
+      strategy: STRATEGY_TRUNCATE,
+      want: STRATEGY_TRUNCATE,
+      parts: []string{strings.Repeat("a", 30)},
+      sent: []PageRange{{1, 1}},
+    },
+    {
+      name: "single page over the limit chunked",
+      pages: []string{strings.Repeat("a", 40)},
+      strategy: STRATEGY_CHUNK,
+      want: STRATEGY_CHUNK,
+      parts: []string{strings.Repeat("a", 30), strings.Repeat("a", 10)},
+      sent: []PageRange{{1, 1}, {1, 1}},
+    },
+    {
+      name: "oversized page mid-chunk",
+      pages: []string{a, strings.Repeat("b", 40), c},
+      strategy: STRATEGY_CHUNK,
+      want: STRATEGY_CHUNK,
+      parts: []string{a, strings.Repeat("b", 30), strings.Repeat("b", 10), c},
+      sent: []PageRange{{1, 1}, {2, 2}, {2, 2}, {3, 3}},
+    },
+    {
+      name: "pages grouped in chunks",
+      pages: []string{a, b, c},
+      strategy: STRATEGY_CHUNK,
+      want: STRATEGY_CHUNK,
+      parts: []string{a + pdf.PAGE_BREAK + b, c},
+      sent: []PageRange{{1, 2}, {3, 3}},
+    },
+    {
+      name: "middle pages omitted",
+      pages: []string{"a", "b", "c", strings.Repeat("d", 30), strings.Repeat("e", 30)},
+      strategy: STRATEGY_TRUNCATE,
+      want: STRATEGY_TRUNCATE,
+      parts: []string{strings.Join([]string{"a", "b", "c", "[pages 4-4 omitted]", strings.Repeat("e", 15)}, pdf.PAGE_BREAK)},
+      sent: []PageRange{{1, 3}, {5, 5}},
+    },
+    {
+      // The last page takes half of the limit, the first gets what's left.
+      name: "first page cut next to the last",
+      pages: []string{strings.Repeat("a", 60), strings.Repeat("b", 60)},
+      strategy: STRATEGY_TRUNCATE,
+      want: STRATEGY_TRUNCATE,
+      parts: []string{strings.Repeat("a", 15) + pdf.PAGE_BREAK + strings.Repeat("b", 15)},
+      sent: []PageRange{{1, 1}, {2, 2}},
+    },
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      strategy, parts := PlanDocument(c.pages, LongDocumentSettings{MaxTokens: 10, Strategy: c.strategy})
+      if strategy.Name != c.want || strategy.Pages != len(c.pages) {
+        t.Errorf("strategy = %v, want %s of %d pages", strategy, c.want, len(c.pages))
+      }
+      if !reflect.DeepEqual(parts, c.parts) {
+        t.Errorf("parts = %q, want %q", parts, c.parts)
+      }
+      if !reflect.DeepEqual(strategy.Sent, c.sent) {
+        t.Errorf("sent = %v, want %v", strategy.Sent, c.sent)
+      }
+      for i, part := range parts {
+        if part == "" {
+          t.Errorf("part %d is empty", i + 1)
+        }
+      }
+    })
+  }
+}
@@ -0,0 +1,144 @@
+package llm
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/krol22/invoice_go_sort_sort/env"
+)
+
+// The prompts ship with the binary, PROMPTS_DIR can override any of them with
+// a file of the same name.
+//
+//go:embed prompts
+var embeddedPrompts embed.FS
+
+// Prompt is a template with the "version", "system" and "user" sections, and
+// optional few-shot examples from <name>.examples.json.
+type Prompt struct {
+  Name string
+  Version string
+  Examples []Example
+  template *template.Template
+}
+
+type Example struct {
+  Input string `json:"input"`
+  Output map[string]interface{} `json:"output"`
+}
+
+var templateFuncs = template.FuncMap{
+  "json": func(value interface{}) (string, error) {
+    data, err := json.Marshal(value)
+    return string(data), err
+  },
+  "untrusted": escapeUntrusted,
+}
+
+// PromptsDir overrides PROMPTS_DIR, e.g. to compare two sets of prompts in
+// the evaluation.
+var PromptsDir string
+
+// readPromptFile prefers PROMPTS_DIR over the embedded prompts. The second
+// value is false when the file exists in neither.
+func readPromptFile(filename string) ([]byte, bool, error) {
+  dir := PromptsDir
+  if dir == "" {
+    dir = env.Get("PROMPTS_DIR")
+  }
+
+  if dir != "" {
+    data, err := os.ReadFile(filepath.Join(dir, filename))
+    if err == nil {
+      return data, true, nil
+    }
+    if !os.IsNotExist(err) {
+      return nil, false, fmt.Errorf("error reading prompt %s: %v", filename, err)
+    }
+  }
+
+  data, err := embeddedPrompts.ReadFile("prompts/" + filename)
+  if err != nil {
+    return nil, false, nil
+  }
+  return data, true, nil
+}
+
+func LoadPrompt(name string) (*Prompt, error) {
+  source, ok, err := readPromptFile(name + ".tmpl")
+  if err != nil {
+    return nil, err
+  }
+  if !ok {
+    return nil, fmt.Errorf("prompt %s not found", name)
+  }
+
+  tmpl, err := template.New(name).Funcs(templateFuncs).Parse(string(source))
+  if err != nil {
+    return nil, fmt.Errorf("error parsing prompt %s: %v", name, err)
+  }
+
+  prompt := &Prompt{
+    Name: name,
+    template: tmpl,
+  }
+
+  version, err := prompt.render("version", nil)
+  if err != nil || strings.TrimSpace(version) == "" {
+    return nil, fmt.Errorf("prompt %s has no version", name)
+  }
+  prompt.Version = strings.TrimSpace(version)
+
+  examples, ok, err := readPromptFile(name + ".examples.json")
+  if err != nil {
+    return nil, err
+  }
+  if ok {
+    if err := json.Unmarshal(examples, &prompt.Examples); err != nil {
+      return nil, fmt.Errorf("error unmarshalling examples of %s: %v", name, err)
+    }
+  }
+
+  return prompt, nil
+}
+
+func (p *Prompt) render(section string, data interface{}) (string, error) {
+  if p.template.Lookup(section) == nil {
+    return "", nil
+  }
+
+  var buf bytes.Buffer
+  if err := p.template.ExecuteTemplate(&buf, section, data); err != nil {
+    return "", fmt.Errorf("error rendering %s of prompt %s: %v", section, p.Name, err)
+  }
+  return strings.TrimSpace(buf.String()), nil
+}
+
+// Render returns the system and user prompts. The examples are available in
+// the templates as .Examples, next to the fields of the input. The text of the
+// document goes between the .Boundary tags, escaped with the untrusted func.
+func (p *Prompt) Render(input interface{}) (string, string, error) {
+  data := map[string]interface{}{
+    "Input": input,
+    "Examples": p.Examples,
+    "Boundary": boundary(input),
+  }
+
+  system, err := p.render("system", data)
+  if err != nil {
+    return "", "", err
+  }
+
+  user, err := p.render("user", data)
+  if err != nil {
+    return "", "", err
+  }
+
+  return system, user, nil
+}
@@ -0,0 +1,59 @@
+package llm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// The documents come from anyone who can send an email, so their text is
+// untrusted. It goes into the prompt between tags named after its own hash:
+// stable for the cache, but impossible to close from inside the text, as the
+// text would have to contain its own hash.
+func boundary(input interface{}) string {
+  data, _ := json.Marshal(input)
+  sum := sha256.Sum256(data)
+  return "document-" + hex.EncodeToString(sum[:12])
+}
+
+var untrustedReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// escapeUntrusted turns the tags in the text into plain text, so the text
+// can't pretend to be a part of the prompt.
+func escapeUntrusted(text string) string {
+  return untrustedReplacer.Replace(text)
+}
+
+// Phrases that have no business in an invoice, but are typical for prompt
+// injections. In English and Polish.
+var suspiciousPatterns = []*regexp.Regexp{
+  regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\b.{0,30}\b(previous|prior|above|earlier|all|system)\b.{0,20}\b(instructions?|prompts?|rules|messages?)`),
+  regexp.MustCompile(`(?i)\b(new|updated|real)\s+instructions?\s*:`),
+  regexp.MustCompile(`(?i)\b(system|developer)\s+(prompt|message)\b`),
+  regexp.MustCompile(`(?i)\byou\s+are\s+(now\s+)?(an?\s+)?(ai|assistant|language\s+model|chatgpt|claude)\b`),
+  regexp.MustCompile(`(?im)^\s*(system|assistant)\s*:`),
+  regexp.MustCompile(`(?i)</?\s*(invoice|document|system|instructions?|example|tool_result|tool_use)[^>]*>`),
+  regexp.MustCompile(`(?i)\b(zignoruj|pomiń|zapomnij).{0,30}\b(poprzednie|wcześniejsze|powyższe|wszystkie)\b.{0,20}\b(instrukcje|polecenia|zasady)`),
+  regexp.MustCompile(`(?i)\bjesteś\s+(teraz\s+)?(asystentem|modelem|ai)\b`),
+}
+
+// SuspiciousContent returns the fragments of the text that look like
+// instructions for the model rather than a part of a document.
+func SuspiciousContent(text string) []string {
+  found := []string{}
+  for _, pattern := range suspiciousPatterns {
+    for _, match := range pattern.FindAllString(text, 3) {
+      found = append(found, strings.TrimSpace(match))
+    }
+  }
+  return found
+}
+
+// Fence puts the untrusted text between the boundary tags, for the text that
+// doesn't go through a prompt template, like the results of the tools.
+func Fence(text string) string {
+  tag := boundary(text)
+  return "<" + tag + ">\n" + escapeUntrusted(text) + "\n</" + tag + ">"
+}
@@ -0,0 +1,153 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Validator checks a single aspect of the output of the task.
+type Validator func(output map[string]interface{}) error
+
+// DateFormat is the format every date in the output has to follow.
+const DateFormat = "2006-01-02"
+
+func parseDateField(output map[string]interface{}, field string) (time.Time, error) {
+  value, ok := output[field].(string)
+  if !ok || value == "" {
+    return time.Time{}, fmt.Errorf("%s is missing", field)
+  }
+
+  date, err := time.Parse(DateFormat, value)
+  if err != nil {
+    return time.Time{}, fmt.Errorf("%s '%s' is not a date in the YYYY-MM-DD format", field, value)
+  }
+
+  return date, nil
+}
+
+func DateParses(field string) Validator {
+  return func(output map[string]interface{}) error {
+    _, err := parseDateField(output, field)
+    return err
+  }
+}
+
+func DateNotInFuture(field string, now func() time.Time) Validator {
+  return func(output map[string]interface{}) error {
+    date, err := parseDateField(output, field)
+    if err != nil {
+      // Reported by DateParses.
+      return nil
+    }
+
+    if date.After(now()) {
+      return fmt.Errorf("%s %s is in the future", field, date.Format(DateFormat))
+    }
+    return nil
+  }
+}
+
+// DateNear checks the date is at most `before` earlier or `after` later than
+// the anchor, e.g. the date the invoice was received.
+func DateNear(field string, anchor time.Time, before time.Duration, after time.Duration) Validator {
+  return func(output map[string]interface{}) error {
+    if anchor.IsZero() {
+      return nil
+    }
+
+    date, err := parseDateField(output, field)
+    if err != nil {
+      // Reported by DateParses.
+      return nil
+    }
+
+    if date.Before(anchor.Add(-before)) || date.After(anchor.Add(after)) {
+      return fmt.Errorf(
+        "%s %s is implausibly far from %s, the date the document was received",
+        field, date.Format(DateFormat), anchor.Format(DateFormat),
+      )
+    }
+    return nil
+  }
+}
+
+// DateInText checks the date is written in the document. An instruction hidden
+// in the text can make the model answer with a date of its choice, but not
+// put that date into the document. Without the text (only the PDF was sent)
+// there is nothing to check against.
+func DateInText(field string, text string) Validator {
+  return func(output map[string]interface{}) error {
+    if strings.TrimSpace(text) == "" {
+      return nil
+    }
+
+    date, err := parseDateField(output, field)
+    if err != nil {
+      // Reported by DateParses.
+      return nil
+    }
+
+    if !textHasDate(text, date) {
+      return fmt.Errorf("%s %s doesn't appear in the document, return the date that does, in the YYYY-MM-DD format", field, date.Format(DateFormat))
+    }
+    return nil
+  }
+}
+
+// IfPresent runs the validator only when the field is in the output, for the
+// fields the model may leave out.
+func IfPresent(field string, validator Validator) Validator {
+  return func(output map[string]interface{}) error {
+    if value, ok := output[field]; !ok || value == nil || value == "" {
+      return nil
+    }
+    return validator(output)
+  }
+}
+
+func OneOf(field string, values ...string) Validator {
+  return func(output map[string]interface{}) error {
+    value, _ := output[field].(string)
+    for _, allowed := range values {
+      if value == allowed {
+        return nil
+      }
+    }
+    return fmt.Errorf("%s '%s' is not one of: %s", field, value, strings.Join(values, ", "))
+  }
+}
+
+// TotalsConsistent checks net + vat = gross, when all three are present.
+func TotalsConsistent(netField string, vatField string, grossField string) Validator {
+  return func(output map[string]interface{}) error {
+    net, netOk := output[netField].(float64)
+    vat, vatOk := output[vatField].(float64)
+    gross, grossOk := output[grossField].(float64)
+    if !netOk || !vatOk || !grossOk {
+      return nil
+    }
+
+    // Allow for rounding of the per-item VAT.
+    if math.Abs(net+vat-gross) > 0.05 {
+      return fmt.Errorf("%s %.2f + %s %.2f doesn't add up to %s %.2f", netField, net, vatField, vat, grossField, gross)
+    }
+    return nil
+  }
+}
+
+func runValidators(output map[string]interface{}, validators []Validator) error {
+  if output == nil {
+    return errors.New("there is no output")
+  }
+
+  var errs []error
+  for _, validator := range validators {
+    if err := validator(output); err != nil {
+      errs = append(errs, err)
+    }
+  }
+  return errors.Join(errs...)
+}
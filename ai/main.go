@@ -1,12 +1,188 @@
 package ai
 
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
 type Message struct {
   Role string `json:"role"`
-  Content string `json:"content"`
+  Content []ContentBlock `json:"content"`
+}
+
+// ContentBlock is a single part of the message: text, a base64 encoded PDF
+// document, an image, or a tool call and its result.
+type ContentBlock struct {
+  Type string `json:"type"`
+  Text string `json:"text,omitempty"`
+  Source *ContentSource `json:"source,omitempty"`
+
+  // tool_use
+  Id string `json:"id,omitempty"`
+  Name string `json:"name,omitempty"`
+  Input map[string]interface{} `json:"input,omitempty"`
+
+  // tool_result
+  ToolUseId string `json:"tool_use_id,omitempty"`
+  Content string `json:"content,omitempty"`
+  IsError bool `json:"is_error,omitempty"`
+}
+
+type ContentSource struct {
+  Type string `json:"type"`
+  MediaType string `json:"media_type"`
+  Data string `json:"data"`
 }
 
 type AiResponse struct {
+  // All the text blocks of the response.
   Message Message
+  // Input of the data_extractor tool call, if there was one.
   JsonOutput map[string]interface{}
+  ToolCalls []ToolCall
+  StopReason string
+  Model string
+  // Version of the prompt that produced the response, so changes in the
+  // output can be traced back to the prompt changes.
+  PromptVersion string
+  Usage Usage
+  // The models a routed task went through, see Config.Routes.
+  Route []RouteStep
+}
+
+type ToolCall struct {
+  Id string
+  Name string
+  Input map[string]interface{}
+}
+
+func NewMessage(role string, blocks ...ContentBlock) Message {
+  return Message{
+    Role: role,
+    Content: blocks,
+  }
+}
+
+func NewTextMessage(role string, text string) Message {
+  return NewMessage(role, TextBlock(text))
+}
+
+func TextBlock(text string) ContentBlock {
+  return ContentBlock{
+    Type: "text",
+    Text: text,
+  }
+}
+
+func DocumentBlock(pdf []byte) ContentBlock {
+  return ContentBlock{
+    Type: "document",
+    Source: &ContentSource{
+      Type: "base64",
+      MediaType: "application/pdf",
+      Data: base64.StdEncoding.EncodeToString(pdf),
+    },
+  }
 }
 
+// ImageBlock wraps an image, mediaType is one of image/jpeg, image/png,
+// image/gif or image/webp.
+func ImageBlock(mediaType string, image []byte) ContentBlock {
+  return ContentBlock{
+    Type: "image",
+    Source: &ContentSource{
+      Type: "base64",
+      MediaType: mediaType,
+      Data: base64.StdEncoding.EncodeToString(image),
+    },
+  }
+}
+
+func ToolUseBlock(call ToolCall) ContentBlock {
+  return ContentBlock{
+    Type: "tool_use",
+    Id: call.Id,
+    Name: call.Name,
+    Input: call.Input,
+  }
+}
+
+func ToolResultBlock(toolUseId string, content string, isError bool) ContentBlock {
+  return ContentBlock{
+    Type: "tool_result",
+    ToolUseId: toolUseId,
+    Content: content,
+    IsError: isError,
+  }
+}
+
+// Text joins all the text blocks of the message.
+func (m Message) Text() string {
+  var texts []string
+  for _, block := range m.Content {
+    if block.Type == "text" {
+      texts = append(texts, block.Text)
+    }
+  }
+  return strings.Join(texts, "\n")
+}
+
+// splitSystem takes the "system" messages out, the API wants the system prompt
+// as a separate field.
+func splitSystem(messages []Message) (string, []Message) {
+  var system []string
+  var rest []Message
+  for _, message := range messages {
+    if message.Role == "system" {
+      if text := message.Text(); text != "" {
+        system = append(system, text)
+      }
+      continue
+    }
+    rest = append(rest, message)
+  }
+  return strings.Join(system, "\n\n"), rest
+}
+
+func hasDocuments(messages []Message) bool {
+  for _, message := range messages {
+    for _, block := range message.Content {
+      if block.Type == "document" {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// loggableBody replaces the base64 payloads with their size, so we don't dump
+// whole documents into the logs.
+func loggableBody(body map[string]interface{}) map[string]interface{} {
+  messages, ok := body["messages"].([]Message)
+  if !ok {
+    return body
+  }
+
+  copied := make(map[string]interface{}, len(body))
+  for key, value := range body {
+    copied[key] = value
+  }
+
+  loggable := make([]Message, len(messages))
+  for i, message := range messages {
+    blocks := make([]ContentBlock, len(message.Content))
+    for j, block := range message.Content {
+      if block.Source != nil {
+        source := *block.Source
+        source.Data = fmt.Sprintf("<%d bytes>", len(source.Data))
+        block.Source = &source
+      }
+      blocks[j] = block
+    }
+    loggable[i] = Message{Role: message.Role, Content: blocks}
+  }
+  copied["messages"] = loggable
+
+  return copied
+}
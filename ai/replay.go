@@ -0,0 +1,119 @@
+package ai
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// ReplayTransport serves recorded responses instead of calling the API, so
+// the evaluation can run without the network. In the record mode it calls the
+// API and saves the responses for later.
+type ReplayTransport struct {
+  dir string
+  record bool
+  next http.RoundTripper
+}
+
+type recording struct {
+  Status int `json:"status"`
+  Header http.Header `json:"header"`
+  Body string `json:"body"`
+}
+
+func NewReplayTransport(dir string, record bool) *ReplayTransport {
+  return &ReplayTransport{
+    dir: dir,
+    record: record,
+    next: http.DefaultTransport,
+  }
+}
+
+// requestKey hashes the method, path and body, everything else (like the API
+// key) doesn't change the answer.
+func requestKey(req *http.Request, body []byte) string {
+  hash := sha256.New()
+  hash.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+  hash.Write(body)
+  return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+  var body []byte
+  if req.Body != nil {
+    var err error
+    body, err = io.ReadAll(req.Body)
+    req.Body.Close()
+    if err != nil {
+      return nil, fmt.Errorf("error reading request body: %v", err)
+    }
+  }
+
+  path := filepath.Join(t.dir, requestKey(req, body)+".json")
+
+  if t.record {
+    return t.recordResponse(req, body, path)
+  }
+
+  data, err := os.ReadFile(path)
+  if os.IsNotExist(err) {
+    return nil, fmt.Errorf("no recorded response for the request (%s), record it first", filepath.Base(path))
+  }
+  if err != nil {
+    return nil, fmt.Errorf("error reading recorded response: %v", err)
+  }
+
+  rec := &recording{}
+  if err := json.Unmarshal(data, rec); err != nil {
+    return nil, fmt.Errorf("error unmarshalling recorded response: %v", err)
+  }
+
+  return &http.Response{
+    StatusCode: rec.Status,
+    Status: http.StatusText(rec.Status),
+    Header: rec.Header,
+    Body: io.NopCloser(bytes.NewBufferString(rec.Body)),
+    ContentLength: int64(len(rec.Body)),
+    Request: req,
+  }, nil
+}
+
+func (t *ReplayTransport) recordResponse(req *http.Request, body []byte, path string) (*http.Response, error) {
+  req.Body = io.NopCloser(bytes.NewReader(body))
+  resp, err := t.next.RoundTrip(req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+
+  respBody, err := io.ReadAll(resp.Body)
+  if err != nil {
+    return nil, fmt.Errorf("error reading response: %v", err)
+  }
+
+  if err := os.MkdirAll(t.dir, 0700); err != nil {
+    return nil, fmt.Errorf("error creating recordings directory: %v", err)
+  }
+
+  data, err := json.MarshalIndent(&recording{
+    Status: resp.StatusCode,
+    Header: resp.Header,
+    Body: string(respBody),
+  }, "", "  ")
+  if err != nil {
+    return nil, fmt.Errorf("error marshalling recording: %v", err)
+  }
+
+  if err := os.WriteFile(path, data, 0600); err != nil {
+    return nil, fmt.Errorf("error writing recording: %v", err)
+  }
+
+  resp.Body = io.NopCloser(bytes.NewReader(respBody))
+  return resp, nil
+}
@@ -0,0 +1,197 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Route sends a task to a cheap model first, and to the stronger ones only
+// when its answer isn't good enough.
+type Route struct {
+  // From the cheapest to the strongest.
+  Models []string `json:"models"`
+  // Fields the first two models have to agree on. Both of them are asked,
+  // a disagreement escalates to the next model, or ends with a
+  // DisagreementError when there is none.
+  Compare []string `json:"compare,omitempty"`
+}
+
+// What happened at a step of the route.
+const (
+  ROUTE_ACCEPTED = "accepted"
+  ROUTE_INVALID = "invalid"
+  ROUTE_LOW_SCORE = "low score"
+  ROUTE_FAILED = "failed"
+  ROUTE_AGREED = "agreed"
+  ROUTE_DISAGREED = "disagreed"
+)
+
+// RouteStep is a model the task went through, AiResponse.Route has all of
+// them in order.
+type RouteStep struct {
+  Model string `json:"model"`
+  Outcome string `json:"outcome"`
+  Score *float64 `json:"score,omitempty"`
+  Details string `json:"details,omitempty"`
+}
+
+// DisagreementError is returned when the compared models answered
+// differently, together with the answer of the stronger one.
+type DisagreementError struct {
+  Fields []string
+  Answers map[string]map[string]interface{}
+}
+
+func (e *DisagreementError) Error() string {
+  models := make([]string, 0, len(e.Answers))
+  for model := range e.Answers {
+    models = append(models, model)
+  }
+  sort.Strings(models)
+
+  answers := make([]string, len(models))
+  for i, model := range models {
+    answers[i] = fmt.Sprintf("%s: %v", model, e.Answers[model])
+  }
+  return fmt.Sprintf("models disagree on %s (%s)", strings.Join(e.Fields, ", "), strings.Join(answers, "; "))
+}
+
+// attempts gives the cheap models a single attempt, a validation error moves
+// the task to the next model right away. The last one gets them all.
+func (r Route) attempts(i int, maxAttempts int) int {
+  if i < len(r.Models) - 1 {
+    return 1
+  }
+  return maxAttempts
+}
+
+func (c *AnthropicClient) runRoute(ctx context.Context, llm LLM, route Route) (*AiResponse, error) {
+  if len(route.Compare) > 0 && len(route.Models) >= 2 {
+    return c.runCompare(ctx, llm, route)
+  }
+
+  return c.continueRoute(ctx, llm, route, 0, nil)
+}
+
+// continueRoute goes through the models of the route from the given one.
+func (c *AnthropicClient) continueRoute(ctx context.Context, llm LLM, route Route, from int, path []RouteStep) (*AiResponse, error) {
+  var res *AiResponse
+  var err error
+  for i := from; i < len(route.Models); i++ {
+    res, err = c.runModel(ctx, llm, route.Models[i], route.attempts(i, c.config.MaxAttempts))
+
+    var done bool
+    path, done = c.judge(llm, route, i, res, err, path)
+    if done {
+      break
+    }
+  }
+
+  if res != nil {
+    res.Route = path
+  }
+  return res, err
+}
+
+// judge records the step and tells if the answer is final: good enough, from
+// the last model, or an error a stronger model won't fix.
+func (c *AnthropicClient) judge(llm LLM, route Route, i int, res *AiResponse, err error, path []RouteStep) ([]RouteStep, bool) {
+  step := RouteStep{Model: route.Models[i]}
+  last := i == len(route.Models) - 1
+
+  var validationErr *ValidationError
+  switch {
+  case errors.As(err, &validationErr):
+    step.Outcome = ROUTE_INVALID
+    step.Details = validationErr.Err.Error()
+  case err != nil:
+    step.Outcome = ROUTE_FAILED
+    step.Details = err.Error()
+    last = true
+  default:
+    step.Outcome = ROUTE_ACCEPTED
+    if scored, ok := llm.(ScoredLLM); ok {
+      score := scored.Score()
+      step.Score = &score
+      if score < c.config.EscalationThreshold {
+        step.Outcome = ROUTE_LOW_SCORE
+      }
+    }
+  }
+
+  path = append(path, step)
+  done := step.Outcome == ROUTE_ACCEPTED || last
+  if !done {
+    l.Print("Escalating ", llm.GetName(), " from ", step.Model, " (", step.Outcome, ") to ", route.Models[i + 1], ".")
+  }
+
+  return path, done
+}
+
+// runCompare asks the first two models and compares the fields. When they
+// agree the answer of the stronger one is taken without looking at the
+// score, two models saying the same is worth more.
+func (c *AnthropicClient) runCompare(ctx context.Context, llm LLM, route Route) (*AiResponse, error) {
+  answers := map[string]map[string]interface{}{}
+  path := []RouteStep{}
+
+  var res *AiResponse
+  for i := 0; i < 2; i++ {
+    model := route.Models[i]
+
+    var err error
+    res, err = c.runModel(ctx, llm, model, c.config.MaxAttempts)
+    if err != nil {
+      // Nothing to compare, the rest of the route decides.
+      var done bool
+      path, done = c.judge(llm, route, i, res, err, path)
+      if !done {
+        return c.continueRoute(ctx, llm, route, i + 1, path)
+      }
+      if res != nil {
+        res.Route = path
+      }
+      return res, err
+    }
+
+    answers[model] = res.JsonOutput
+    path = append(path, RouteStep{Model: model, Outcome: ROUTE_ACCEPTED})
+  }
+
+  disagreement := compareAnswers(route, answers)
+  if disagreement == nil {
+    path[1].Outcome = ROUTE_AGREED
+    path[1].Details = "on " + strings.Join(route.Compare, ", ")
+    res.Route = path
+    return res, nil
+  }
+
+  path[1].Outcome = ROUTE_DISAGREED
+  path[1].Details = disagreement.Error()
+  if len(route.Models) > 2 {
+    l.Print("Models disagree on ", llm.GetName(), ", escalating to ", route.Models[2], ".")
+    return c.continueRoute(ctx, llm, route, 2, path)
+  }
+
+  res.Route = path
+  return res, disagreement
+}
+
+func compareAnswers(route Route, answers map[string]map[string]interface{}) *DisagreementError {
+  first, second := answers[route.Models[0]], answers[route.Models[1]]
+
+  fields := []string{}
+  for _, field := range route.Compare {
+    if fmt.Sprint(first[field]) != fmt.Sprint(second[field]) {
+      fields = append(fields, field)
+    }
+  }
+
+  if len(fields) == 0 {
+    return nil
+  }
+  return &DisagreementError{Fields: fields, Answers: answers}
+}
@@ -0,0 +1,188 @@
+package ai_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/ai/anthropictest"
+	"github.com/krol22/invoice_go_sort_sort/ai/llm"
+)
+
+const (
+  cheapModel = "claude-3-5-haiku-20241022"
+  strongModel = "claude-3-5-sonnet-20241022"
+)
+
+func newRoutedClient(t *testing.T, route ai.Route) (*ai.AnthropicClient, *anthropictest.Server) {
+  t.Helper()
+
+  server := anthropictest.NewServer()
+  t.Cleanup(server.Close)
+
+  config := ai.DefaultConfig()
+  config.BaseUrl = server.URL
+  config.BatchPollInterval = time.Millisecond
+  config.Routes["analyze_invoice"] = route
+
+  return ai.NewClient("test-key", ai.WithConfig(config)), server
+}
+
+func requestedModels(server *anthropictest.Server) []string {
+  models := []string{}
+  for _, request := range server.Requests() {
+    if model, ok := request.Body["model"].(string); ok {
+      models = append(models, model)
+    }
+  }
+  return models
+}
+
+func outcomes(route []ai.RouteStep) []string {
+  result := make([]string, len(route))
+  for i, step := range route {
+    result[i] = step.Model + ":" + step.Outcome
+  }
+  return result
+}
+
+func TestRouteStopsAtConfidentCheapModel(t *testing.T) {
+  client, server := newRoutedClient(t, ai.Route{Models: []string{cheapModel, strongModel}})
+  server.Enqueue(anthropictest.ToolUse(validOutput()))
+
+  response, err := client.RunLLM(context.Background(), newAnalyzeInvoice())
+  if err != nil {
+    t.Fatalf("RunLLM: %v", err)
+  }
+
+  if got := requestedModels(server); !slices.Equal(got, []string{cheapModel}) {
+    t.Errorf("models = %v, want only the cheap one", got)
+  }
+  if got := outcomes(response.Route); !slices.Equal(got, []string{cheapModel + ":accepted"}) {
+    t.Errorf("route = %v", got)
+  }
+}
+
+func TestRouteEscalatesLowScore(t *testing.T) {
+  client, server := newRoutedClient(t, ai.Route{Models: []string{cheapModel, strongModel}})
+  server.Enqueue(
+    anthropictest.ToolUse(map[string]interface{}{"date": "2024-03-15", "dateConfidence": 0.3}),
+    anthropictest.ToolUse(validOutput()),
+  )
+
+  task := newAnalyzeInvoice()
+  response, err := client.RunLLM(context.Background(), task)
+  if err != nil {
+    t.Fatalf("RunLLM: %v", err)
+  }
+
+  if got := requestedModels(server); !slices.Equal(got, []string{cheapModel, strongModel}) {
+    t.Errorf("models = %v", got)
+  }
+  if got := outcomes(response.Route); !slices.Equal(got, []string{cheapModel + ":low score", strongModel + ":accepted"}) {
+    t.Errorf("route = %v", got)
+  }
+  if task.GetAiResponse() != response {
+    t.Error("the task doesn't have the final response")
+  }
+}
+
+func TestRouteEscalatesInvalidOutputRightAway(t *testing.T) {
+  client, server := newRoutedClient(t, ai.Route{Models: []string{cheapModel, strongModel}})
+  server.Enqueue(
+    anthropictest.ToolUse(map[string]interface{}{"date": "15.03.2024", "dateConfidence": 0.9}),
+    anthropictest.ToolUse(validOutput()),
+  )
+
+  response, err := client.RunLLM(context.Background(), newAnalyzeInvoice())
+  if err != nil {
+    t.Fatalf("RunLLM: %v", err)
+  }
+
+  if got := outcomes(response.Route); !slices.Equal(got, []string{cheapModel + ":invalid", strongModel + ":accepted"}) {
+    t.Errorf("route = %v", got)
+  }
+}
+
+func TestRouteDoesNotEscalateAPIErrors(t *testing.T) {
+  client, server := newRoutedClient(t, ai.Route{Models: []string{cheapModel, strongModel}})
+  server.Enqueue(anthropictest.Error(400, "invalid_request_error", "bad request"))
+
+  _, err := client.RunLLM(context.Background(), newAnalyzeInvoice())
+
+  var apiErr *ai.APIError
+  if !errors.As(err, &apiErr) {
+    t.Fatalf("err = %v, want the APIError", err)
+  }
+  if got := len(server.Requests()); got != 1 {
+    t.Errorf("got %d requests, want 1", got)
+  }
+}
+
+func TestRouteComparesModels(t *testing.T) {
+  client, server := newRoutedClient(t, ai.Route{Models: []string{cheapModel, strongModel}, Compare: []string{"date"}})
+  server.Enqueue(
+    anthropictest.ToolUse(validOutput()),
+    anthropictest.ToolUse(map[string]interface{}{"date": "2024-03-15", "dateConfidence": 0.8}),
+  )
+
+  response, err := client.RunLLM(context.Background(), newAnalyzeInvoice())
+  if err != nil {
+    t.Fatalf("RunLLM: %v", err)
+  }
+  if got := outcomes(response.Route); !slices.Equal(got, []string{cheapModel + ":accepted", strongModel + ":agreed"}) {
+    t.Errorf("route = %v", got)
+  }
+}
+
+func TestRouteReportsDisagreement(t *testing.T) {
+  client, server := newRoutedClient(t, ai.Route{Models: []string{cheapModel, strongModel}, Compare: []string{"date"}})
+  server.Enqueue(
+    anthropictest.ToolUse(validOutput()),
+    anthropictest.ToolUse(map[string]interface{}{"date": "2024-03-16", "dateConfidence": 0.8}),
+  )
+
+  task := llm.NewAnalyzeInvoiceLLM(&llm.AnalyzeInvoiceLLMInput{
+    Invoice: invoiceText + "\nData sprzedaży: 2024-03-16",
+    ReceivedAt: time.Date(2024, 3, 16, 10, 0, 0, 0, time.UTC),
+  })
+  _, err := client.RunLLM(context.Background(), task)
+
+  var disagreement *ai.DisagreementError
+  if !errors.As(err, &disagreement) {
+    t.Fatalf("err = %v, want a DisagreementError", err)
+  }
+  if !slices.Equal(disagreement.Fields, []string{"date"}) {
+    t.Errorf("Fields = %v, want date", disagreement.Fields)
+  }
+}
+
+func TestRunBatchEscalatesWithRegularRequests(t *testing.T) {
+  client, server := newRoutedClient(t, ai.Route{Models: []string{cheapModel, strongModel}})
+  server.Enqueue(
+    anthropictest.ToolUse(validOutput()),
+    anthropictest.ToolUse(map[string]interface{}{"date": "2024-03-15", "dateConfidence": 0.2}),
+    anthropictest.ToolUse(validOutput()),
+  )
+
+  results, err := client.RunBatch(context.Background(), []ai.LLM{newAnalyzeInvoice(), newAnalyzeInvoice()})
+  if err != nil {
+    t.Fatalf("RunBatch: %v", err)
+  }
+
+  if got := outcomes(results[0].Response.Route); !slices.Equal(got, []string{cheapModel + ":accepted"}) {
+    t.Errorf("route of the first task = %v", got)
+  }
+  if got := outcomes(results[1].Response.Route); !slices.Equal(got, []string{cheapModel + ":low score", strongModel + ":accepted"}) {
+    t.Errorf("route of the second task = %v", got)
+  }
+
+  requests := server.Requests()
+  last := requests[len(requests)-1]
+  if last.Path != "/v1/messages/" || last.Body["model"] != strongModel {
+    t.Errorf("last request = %s %v, want the strong model on its own", last.Path, last.Body["model"])
+  }
+}
@@ -0,0 +1,262 @@
+package ai
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Kinds of the StreamEvent.
+const (
+  STREAM_TEXT = "text"
+  STREAM_TOOL_INPUT = "tool_input"
+)
+
+// StreamEvent is a piece of a response as it arrives.
+type StreamEvent struct {
+  Type string
+  // Index of the content block in the response.
+  Index int
+  // The next piece of the text, or of the JSON input of the tool call.
+  Delta string
+  // Name of the tool, for the tool input.
+  ToolName string
+}
+
+// StreamHandler gets the events in order, from the goroutine of the request.
+type StreamHandler func(event StreamEvent)
+
+type streamKey struct{}
+
+func withStream(ctx context.Context, handler StreamHandler) context.Context {
+  return context.WithValue(ctx, streamKey{}, handler)
+}
+
+func streamHandler(ctx context.Context) StreamHandler {
+  handler, _ := ctx.Value(streamKey{}).(StreamHandler)
+  return handler
+}
+
+// AskChatStream is AskChat with the answer streamed to the handler. The
+// returned response is the same as AskChat would return.
+func (c *AnthropicClient) AskChatStream(ctx context.Context, messages []Message, handler StreamHandler) (*AiResponse, error) {
+  return c.AskChat(withStream(ctx, handler), messages)
+}
+
+// AskChatWithToolsStream is AskChatWithTools with every response streamed to
+// the handler, the text before the tool calls included.
+func (c *AnthropicClient) AskChatWithToolsStream(ctx context.Context, messages []Message, tools []Tool, handler StreamHandler) (*AiResponse, []Message, error) {
+  return c.AskChatWithTools(withStream(ctx, handler), messages, tools)
+}
+
+// RunLLMStream is RunLLM reporting the progress of the tool input. With the
+// corrections and the routing there can be more than one response, each is
+// streamed in turn.
+func (c *AnthropicClient) RunLLMStream(ctx context.Context, llm LLM, handler StreamHandler) (*AiResponse, error) {
+  return c.RunLLM(withStream(ctx, handler), llm)
+}
+
+// anthropicStreamEvent covers all the server-sent events of the Messages API,
+// each uses only some of the fields.
+type anthropicStreamEvent struct {
+  Type string `json:"type"`
+  Message anthropicResponse `json:"message"`
+  Index int `json:"index"`
+  ContentBlock anthropicContent `json:"content_block"`
+  Delta struct {
+    Type string `json:"type"`
+    Text string `json:"text"`
+    PartialJson string `json:"partial_json"`
+    StopReason string `json:"stop_reason"`
+    StopSequence string `json:"stop_sequence"`
+  } `json:"delta"`
+  Usage anthropicUsage `json:"usage"`
+  Error struct {
+    Type string `json:"type"`
+    Message string `json:"message"`
+  } `json:"error"`
+}
+
+// receiveStream reads the server-sent events into the same response the API
+// returns without streaming.
+func (c *AnthropicClient) receiveStream(req *http.Request, handler StreamHandler) (*anthropicResponse, error) {
+  resp, err := c.send(c.streamClient(), req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+
+  // Errors before the stream starts are regular JSON responses.
+  if resp.StatusCode != http.StatusOK {
+    body, _ := io.ReadAll(resp.Body)
+    return nil, &APIError{StatusCode: resp.StatusCode, Body: string(body)}
+  }
+
+  response := &anthropicResponse{}
+  toolInputs := map[int]*strings.Builder{}
+
+  scanner := bufio.NewScanner(resp.Body)
+  // A single event can carry a long piece of text.
+  scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+
+  ended := false
+  for scanner.Scan() {
+    line := scanner.Text()
+    data, ok := strings.CutPrefix(line, "data:")
+    if !ok {
+      // "event:" repeats the type of the data, the rest are comments.
+      continue
+    }
+
+    event := anthropicStreamEvent{}
+    if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+      return nil, fmt.Errorf("error unmarshalling stream event: %v", err)
+    }
+
+    switch event.Type {
+    case "message_start":
+      *response = event.Message
+      response.Content = nil
+    case "content_block_start":
+      block := event.ContentBlock
+      if block.Type == "tool_use" {
+        toolInputs[event.Index] = &strings.Builder{}
+      }
+      for len(response.Content) <= event.Index {
+        response.Content = append(response.Content, anthropicContent{})
+      }
+      response.Content[event.Index] = block
+    case "content_block_delta":
+      if event.Index >= len(response.Content) {
+        return nil, fmt.Errorf("stream delta for unknown content block %d", event.Index)
+      }
+      block := &response.Content[event.Index]
+
+      switch event.Delta.Type {
+      case "text_delta":
+        block.Text += event.Delta.Text
+        handler(StreamEvent{Type: STREAM_TEXT, Index: event.Index, Delta: event.Delta.Text})
+      case "input_json_delta":
+        input, ok := toolInputs[event.Index]
+        if !ok {
+          return nil, fmt.Errorf("stream tool input for content block %d that isn't a tool call", event.Index)
+        }
+        input.WriteString(event.Delta.PartialJson)
+        handler(StreamEvent{Type: STREAM_TOOL_INPUT, Index: event.Index, Delta: event.Delta.PartialJson, ToolName: block.Name})
+      }
+    case "content_block_stop":
+      input, ok := toolInputs[event.Index]
+      if !ok || input.Len() == 0 {
+        continue
+      }
+      block := &response.Content[event.Index]
+      block.Input = nil
+      if err := json.Unmarshal([]byte(input.String()), &block.Input); err != nil {
+        // A truncated input, the stop reason tells what happened.
+        l.Warn().Err(err).Msg("Incomplete tool input in the stream")
+        block.Input = nil
+      }
+    case "message_delta":
+      response.StopReason = event.Delta.StopReason
+      response.StopSequence = event.Delta.StopSequence
+      // The counts in message_delta are cumulative.
+      response.Usage.OutputTokens = event.Usage.OutputTokens
+      if event.Usage.InputTokens > 0 {
+        response.Usage.InputTokens = event.Usage.InputTokens
+      }
+    case "message_stop":
+      ended = true
+    case "error":
+      // The status code is already sent, the overloads come this way too.
+      statusCode := http.StatusInternalServerError
+      if event.Error.Type == "overloaded_error" {
+        statusCode = STATUS_OVERLOADED
+      }
+      return nil, &APIError{StatusCode: statusCode, Body: strings.TrimSpace(data)}
+    }
+  }
+
+  if err := scanner.Err(); err != nil {
+    return nil, fmt.Errorf("error reading stream: %v", err)
+  }
+  if !ended {
+    return nil, fmt.Errorf("stream ended before message_stop")
+  }
+
+  return response, nil
+}
+
+// streamClient is the http client without the timeout of the whole request,
+// which would cut off a long answer. The timeout is for the response to start
+// and then for every next piece of it instead, see idleTimeout.
+func (c *AnthropicClient) streamClient() *http.Client {
+  client := *c.httpClient
+  if client.Timeout <= 0 {
+    return &client
+  }
+
+  transport := client.Transport
+  if transport == nil {
+    transport = http.DefaultTransport
+  }
+  client.Transport = &idleTimeout{transport: transport, timeout: client.Timeout}
+  client.Timeout = 0
+  return &client
+}
+
+// idleTimeout cancels the context of the request when the response doesn't
+// start, or the body doesn't get any data, within the timeout.
+type idleTimeout struct {
+  transport http.RoundTripper
+  timeout time.Duration
+}
+
+func (t *idleTimeout) RoundTrip(req *http.Request) (*http.Response, error) {
+  ctx, cancel := context.WithCancelCause(req.Context())
+  timer := time.AfterFunc(t.timeout, func() {
+    cancel(fmt.Errorf("no response from the stream for %v", t.timeout))
+  })
+
+  resp, err := t.transport.RoundTrip(req.WithContext(ctx))
+  if err != nil {
+    timer.Stop()
+    if cause := context.Cause(ctx); cause != nil && ctx.Err() != nil {
+      err = cause
+    }
+    cancel(nil)
+    return nil, err
+  }
+
+  resp.Body = &idleBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, timer: timer, timeout: t.timeout}
+  return resp, nil
+}
+
+type idleBody struct {
+  io.ReadCloser
+  ctx context.Context
+  cancel context.CancelCauseFunc
+  timer *time.Timer
+  timeout time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+  n, err := b.ReadCloser.Read(p)
+  if err != nil && err != io.EOF && b.ctx.Err() != nil {
+    return n, context.Cause(b.ctx)
+  }
+  if n > 0 {
+    b.timer.Reset(b.timeout)
+  }
+  return n, err
+}
+
+func (b *idleBody) Close() error {
+  b.timer.Stop()
+  b.cancel(nil)
+  return b.ReadCloser.Close()
+}
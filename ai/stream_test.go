@@ -0,0 +1,177 @@
+package ai_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/ai/anthropictest"
+)
+
+func TestAskChatStreamMatchesAskChat(t *testing.T) {
+  client, server := newTestClient(t)
+  answer := "Faktura z 15 marca 2024 na 123,00 zł brutto — OVH Sp. z o.o."
+  server.Enqueue(anthropictest.Text(answer), anthropictest.Text(answer))
+
+  messages := []ai.Message{ai.NewTextMessage("user", "Kiedy wystawiono fakturę?")}
+  want, err := client.AskChat(context.Background(), messages)
+  if err != nil {
+    t.Fatalf("AskChat: %v", err)
+  }
+
+  var streamed strings.Builder
+  deltas := 0
+  got, err := client.AskChatStream(context.Background(), messages, func(event ai.StreamEvent) {
+    if event.Type == ai.STREAM_TEXT {
+      streamed.WriteString(event.Delta)
+      deltas++
+    }
+  })
+  if err != nil {
+    t.Fatalf("AskChatStream: %v", err)
+  }
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("streamed response = %+v, want %+v", got, want)
+  }
+  if streamed.String() != answer || deltas < 2 {
+    t.Errorf("got %q in %d deltas, want the answer in pieces", streamed.String(), deltas)
+  }
+  if stream, _ := server.Requests()[1].Body["stream"].(bool); !stream {
+    t.Error("the request wasn't streamed")
+  }
+}
+
+func TestRunLLMStreamMatchesRunLLM(t *testing.T) {
+  client, server := newTestClient(t)
+  server.Enqueue(anthropictest.ToolUse(validOutput()), anthropictest.ToolUse(validOutput()))
+
+  want, err := client.RunLLM(context.Background(), newAnalyzeInvoice())
+  if err != nil {
+    t.Fatalf("RunLLM: %v", err)
+  }
+
+  var input strings.Builder
+  got, err := client.RunLLMStream(context.Background(), newAnalyzeInvoice(), func(event ai.StreamEvent) {
+    if event.Type == ai.STREAM_TOOL_INPUT && event.ToolName == ai.TOOL_NAME {
+      input.WriteString(event.Delta)
+    }
+  })
+  if err != nil {
+    t.Fatalf("RunLLMStream: %v", err)
+  }
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("streamed response = %+v, want %+v", got, want)
+  }
+
+  var streamedInput map[string]interface{}
+  if err := json.Unmarshal([]byte(input.String()), &streamedInput); err != nil || !reflect.DeepEqual(streamedInput, got.JsonOutput) {
+    t.Errorf("streamed tool input = %q, want the output", input.String())
+  }
+}
+
+func TestRunLLMStreamRetriesTruncatedResponse(t *testing.T) {
+  client, server := newTestClient(t)
+  server.Enqueue(
+    anthropictest.Truncated(map[string]interface{}{"date": "2024-"}),
+    anthropictest.ToolUse(validOutput()),
+  )
+
+  task := newAnalyzeInvoice()
+  if _, err := client.RunLLMStream(context.Background(), task, func(ai.StreamEvent) {}); err != nil {
+    t.Fatalf("RunLLMStream: %v", err)
+  }
+  if got := task.GetOutput().InvoiceDate; got != "2024-03-15" {
+    t.Errorf("InvoiceDate = %q, want 2024-03-15", got)
+  }
+}
+
+func TestAskChatStreamReturnsStreamErrors(t *testing.T) {
+  client, server := newTestClient(t)
+  response := anthropictest.Text("Faktura z 15 marca")
+  response.StreamError = "overloaded_error"
+  server.Enqueue(response)
+
+  messages := []ai.Message{ai.NewTextMessage("user", "Kiedy wystawiono fakturę?")}
+  _, err := client.AskChatStream(context.Background(), messages, func(ai.StreamEvent) {})
+
+  var apiErr *ai.APIError
+  if !errors.As(err, &apiErr) || apiErr.StatusCode != ai.STATUS_OVERLOADED {
+    t.Fatalf("err = %v, want an overloaded APIError", err)
+  }
+}
+
+// streamServer sends the events one by one, each after the delay.
+func streamServer(t *testing.T, delay time.Duration, events ...string) *ai.AnthropicClient {
+  t.Helper()
+
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.WriteHeader(http.StatusOK)
+    for _, event := range events {
+      select {
+      case <-time.After(delay):
+      case <-r.Context().Done():
+        return
+      }
+      fmt.Fprintf(w, "data: %s\n\n", event)
+      w.(http.Flusher).Flush()
+    }
+  }))
+  t.Cleanup(server.Close)
+
+  config := ai.DefaultConfig()
+  config.BaseUrl = server.URL
+  config.MaxRetries = 0
+  return ai.NewClient("test-key", ai.WithConfig(config), ai.WithTimeout(200 * time.Millisecond))
+}
+
+func TestAskChatStreamRejectsMalformedStream(t *testing.T) {
+  client := streamServer(t, 0,
+    `{"type":"message_start","message":{"role":"assistant","content":[]}}`,
+    `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+    `{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{}"}}`,
+  )
+
+  messages := []ai.Message{ai.NewTextMessage("user", "Kiedy wystawiono fakturę?")}
+  if _, err := client.AskChatStream(context.Background(), messages, func(ai.StreamEvent) {}); err == nil {
+    t.Fatal("AskChatStream of a tool input for a text block succeeded, want an error")
+  }
+}
+
+func TestAskChatStreamTimesOutBetweenEvents(t *testing.T) {
+  events := []string{
+    `{"type":"message_start","message":{"role":"assistant","content":[]}}`,
+    `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+    `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Faktura "}}`,
+    `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"z 15 marca"}}`,
+    `{"type":"content_block_stop","index":0}`,
+    `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}`,
+    `{"type":"message_stop"}`,
+  }
+  messages := []ai.Message{ai.NewTextMessage("user", "Kiedy wystawiono fakturę?")}
+
+  // Longer than the timeout in all, but never waiting that long.
+  client := streamServer(t, 50 * time.Millisecond, events...)
+  response, err := client.AskChatStream(context.Background(), messages, func(ai.StreamEvent) {})
+  if err != nil {
+    t.Fatalf("AskChatStream of a slow answer: %v", err)
+  }
+  if response.Message.Text() != "Faktura z 15 marca" {
+    t.Errorf("answer = %q, want the whole of it", response.Message.Text())
+  }
+
+  client = streamServer(t, 300 * time.Millisecond, events...)
+  if _, err := client.AskChatStream(context.Background(), messages, func(ai.StreamEvent) {}); err == nil {
+    t.Fatal("AskChatStream of a stalled stream succeeded, want the timeout")
+  }
+}
@@ -0,0 +1,14 @@
+package ai
+
+import "unicode/utf8"
+
+// The tokenizer isn't public. A token is about 3.5 characters of English, less
+// of Polish and of the numbers the invoices are full of, so count 3 and rather
+// overestimate.
+const CHARS_PER_TOKEN = 3
+
+// EstimateTokens is a rough count of the tokens of the text, to decide if it
+// fits before paying for it.
+func EstimateTokens(text string) int {
+  return (utf8.RuneCountInString(text) + CHARS_PER_TOKEN - 1) / CHARS_PER_TOKEN
+}
@@ -2,9 +2,25 @@ package ai
 
 type LLM interface {
   GenerateChat() ([]Message, error)
+  GetName() string
+  // Bump it whenever the prompt changes, so the cached answers are not reused.
+  GetPromptVersion() string
   GetOutputSchema() map[string]interface{}
-  GetMaxTokens() int
 
   SetAiResponse(aiResponse *AiResponse)
   GetAiResponse() *AiResponse
 }
+
+// ValidatedLLM is an LLM that checks its own output. When Validate fails the
+// client asks the model again with the error, up to Config.MaxAttempts times.
+type ValidatedLLM interface {
+  LLM
+  Validate() error
+}
+
+// ScoredLLM is an LLM that can tell how far its output can be trusted, from 0
+// to 1. A routed task goes to the next model below Config.EscalationThreshold.
+type ScoredLLM interface {
+  LLM
+  Score() float64
+}
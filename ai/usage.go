@@ -0,0 +1,152 @@
+package ai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/state"
+)
+
+var ErrBudgetExceeded = errors.New("monthly AI budget exceeded")
+
+type Usage struct {
+  InputTokens int `json:"inputTokens"`
+  OutputTokens int `json:"outputTokens"`
+  // In USD, zero when the model is missing from the price table.
+  Cost float64 `json:"cost"`
+}
+
+// Price is in USD per million tokens.
+type Price struct {
+  Input float64 `json:"input"`
+  Output float64 `json:"output"`
+}
+
+type UsageTotals struct {
+  Requests int `json:"requests"`
+  InputTokens int `json:"inputTokens"`
+  OutputTokens int `json:"outputTokens"`
+  Cost float64 `json:"cost"`
+}
+
+func (t *UsageTotals) add(usage Usage) {
+  t.Requests++
+  t.InputTokens += usage.InputTokens
+  t.OutputTokens += usage.OutputTokens
+  t.Cost += usage.Cost
+}
+
+// UsageLedger sums up the usage of the current run and keeps the monthly
+// totals on disk.
+type UsageLedger struct {
+  path string
+  mu sync.Mutex
+  run UsageTotals
+  Months map[string]*UsageTotals `json:"months"`
+}
+
+func monthKey(t time.Time) string {
+  return t.Format("2006-01")
+}
+
+func LoadUsageLedger() (*UsageLedger, error) {
+  dir, err := state.Dir()
+  if err != nil {
+    return nil, err
+  }
+
+  return OpenUsageLedger(filepath.Join(dir, "usage.json"))
+}
+
+func OpenUsageLedger(path string) (*UsageLedger, error) {
+  ledger := &UsageLedger{
+    path: path,
+    Months: map[string]*UsageTotals{},
+  }
+
+  data, err := os.ReadFile(path)
+  if os.IsNotExist(err) {
+    return ledger, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("error reading usage: %v", err)
+  }
+
+  if err := json.Unmarshal(data, ledger); err != nil {
+    return nil, fmt.Errorf("error unmarshalling usage: %v", err)
+  }
+  if ledger.Months == nil {
+    ledger.Months = map[string]*UsageTotals{}
+  }
+
+  return ledger, nil
+}
+
+// NewUsageLedger creates a ledger that isn't saved anywhere, e.g. to count
+// the cost of an evaluation.
+func NewUsageLedger() *UsageLedger {
+  return &UsageLedger{
+    Months: map[string]*UsageTotals{},
+  }
+}
+
+func (u *UsageLedger) Record(usage Usage) error {
+  u.mu.Lock()
+  defer u.mu.Unlock()
+
+  u.run.add(usage)
+
+  key := monthKey(time.Now())
+  if u.Months[key] == nil {
+    u.Months[key] = &UsageTotals{}
+  }
+  u.Months[key].add(usage)
+
+  if u.path == "" {
+    return nil
+  }
+
+  data, err := json.MarshalIndent(u, "", "  ")
+  if err != nil {
+    return fmt.Errorf("error marshalling usage: %v", err)
+  }
+
+  if err := os.WriteFile(u.path, data, 0600); err != nil {
+    return fmt.Errorf("error writing usage: %v", err)
+  }
+
+  return nil
+}
+
+func (u *UsageLedger) Run() UsageTotals {
+  u.mu.Lock()
+  defer u.mu.Unlock()
+
+  return u.run
+}
+
+func (u *UsageLedger) Month(t time.Time) UsageTotals {
+  u.mu.Lock()
+  defer u.mu.Unlock()
+
+  if totals, ok := u.Months[monthKey(t)]; ok {
+    return *totals
+  }
+  return UsageTotals{}
+}
+
+// Cost converts the tokens to USD, the second value is false when the model
+// has no price.
+func (c *Config) Cost(model string, inputTokens int, outputTokens int) (float64, bool) {
+  price, ok := c.Prices[model]
+  if !ok {
+    return 0, false
+  }
+
+  return (float64(inputTokens)*price.Input + float64(outputTokens)*price.Output) / 1_000_000, true
+}
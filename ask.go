@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/ai/llm"
+	"github.com/krol22/invoice_go_sort_sort/index"
+)
+
+const (
+	DEFAULT_SEARCH_LIMIT = 20
+	MAX_SEARCH_LIMIT     = 100
+	// Enough for any invoice, a long price list would fill the context.
+	MAX_READ_LENGTH = 20000
+)
+
+// runAskCommand answers the question about the archive, or without one reads
+// the questions from the standard input, one per line, as a conversation.
+func runAskCommand(ctx context.Context, args []string) error {
+	records, err := index.Load()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("the index is empty, documents are indexed as they are filed")
+	}
+
+	anthropicClient, ledger, err := newAnthropicClient()
+	if err != nil {
+		return err
+	}
+	defer logUsage(ledger)
+
+	chat, err := newInvoiceChat(anthropicClient, records, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		_, err := chat.ask(ctx, strings.Join(args, " "))
+		return err
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print("> ")
+	for scanner.Scan() {
+		if question := strings.TrimSpace(scanner.Text()); question != "" {
+			if _, err := chat.ask(ctx, question); err != nil {
+				return err
+			}
+		}
+		fmt.Print("> ")
+	}
+
+	return scanner.Err()
+}
+
+// invoiceChat is a conversation about the indexed documents.
+type invoiceChat struct {
+	client   *ai.AnthropicClient
+	records  []index.Record
+	messages []ai.Message
+	out      io.Writer
+}
+
+func newInvoiceChat(client *ai.AnthropicClient, records []index.Record, out io.Writer) (*invoiceChat, error) {
+	system, err := llm.AskInvoicesPrompt(&llm.AskInvoicesInput{
+		Today:     time.Now().Format("2006-01-02"),
+		Documents: len(records),
+		Labels:    llm.DocumentLabels,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &invoiceChat{
+		client:   client,
+		records:  records,
+		messages: []ai.Message{ai.NewTextMessage("system", system)},
+		out:      out,
+	}, nil
+}
+
+// ask streams the answer to the output and returns the paths it cites. A
+// failed question is left out of the conversation.
+func (c *invoiceChat) ask(ctx context.Context, question string) ([]string, error) {
+	messages := append(c.messages[:len(c.messages):len(c.messages)], ai.NewTextMessage("user", question))
+
+	res, messages, err := c.client.AskChatWithToolsStream(ctx, messages, c.tools(), func(event ai.StreamEvent) {
+		if event.Type == ai.STREAM_TEXT {
+			fmt.Fprint(c.out, event.Delta)
+		}
+	})
+	fmt.Fprintln(c.out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to answer: %w", err)
+	}
+	c.messages = messages
+
+	return c.cited(res.Message.Text()), nil
+}
+
+// cited returns the indexed paths the answer refers to, and warns about the
+// ones that aren't in the index: the model made them up.
+func (c *invoiceChat) cited(answer string) []string {
+	cited := []string{}
+	for _, line := range strings.Split(answer, "\n") {
+		path := strings.Trim(strings.TrimSpace(line), "-*`• ")
+		if !strings.Contains(path, "/") || !strings.HasSuffix(strings.ToLower(path), ".pdf") {
+			continue
+		}
+
+		if c.record(path) == nil {
+			l.Warn().Str("path", path).Msg("The answer cites a document that isn't in the index")
+			continue
+		}
+		cited = append(cited, path)
+	}
+	return cited
+}
+
+func (c *invoiceChat) record(path string) *index.Record {
+	for i := range c.records {
+		if c.records[i].Path == path {
+			return &c.records[i]
+		}
+	}
+	return nil
+}
+
+func (c *invoiceChat) tools() []ai.Tool {
+	labels := make([]string, len(llm.DocumentLabels))
+	for i, label := range llm.DocumentLabels {
+		labels[i] = string(label)
+	}
+
+	return []ai.Tool{
+		{
+			Name:        "search_invoices",
+			Description: "Finds the filed documents matching all the given filters, oldest first, and sums their totals. The sums don't look at the currency, and skip the documents with unknown totals.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"query": map[string]interface{}{
+						"type":        "string",
+						"description": "Case-insensitive text to look for in the document, e.g. the name of the seller",
+					},
+					"from": map[string]interface{}{
+						"type":        "string",
+						"description": "The first invoice date, YYYY-MM-DD",
+					},
+					"to": map[string]interface{}{
+						"type":        "string",
+						"description": "The last invoice date, YYYY-MM-DD",
+					},
+					"label": map[string]interface{}{
+						"type":        "string",
+						"enum":        labels,
+						"description": "Kind of the document",
+					},
+					"missingNip": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Only the documents without any NIP in the text",
+					},
+					"limit": map[string]interface{}{
+						"type":        "integer",
+						"description": fmt.Sprintf("How many documents to list, %d by default, at most %d. The sums cover all of them.", DEFAULT_SEARCH_LIMIT, MAX_SEARCH_LIMIT),
+					},
+				},
+			},
+			Run: c.searchInvoices,
+		},
+		{
+			Name:        "read_invoice",
+			Description: "Returns the full text of a filed document.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "Path of the document, as returned by search_invoices",
+					},
+				},
+				"required": []string{"path"},
+			},
+			Run: c.readInvoice,
+		},
+	}
+}
+
+type searchResult struct {
+	Matches   int            `json:"matches"`
+	Totals    searchTotals   `json:"totals"`
+	Documents []searchRecord `json:"documents"`
+}
+
+type searchTotals struct {
+	Net   float64 `json:"net"`
+	Vat   float64 `json:"vat"`
+	Gross float64 `json:"gross"`
+	// How many of the matches have the totals.
+	Known int `json:"known"`
+}
+
+type searchRecord struct {
+	Path        string            `json:"path"`
+	Label       llm.DocumentLabel `json:"label"`
+	InvoiceDate string            `json:"invoiceDate"`
+	NetTotal    *float64          `json:"netTotal,omitempty"`
+	VatTotal    *float64          `json:"vatTotal,omitempty"`
+	GrossTotal  *float64          `json:"grossTotal,omitempty"`
+	Nips        []string          `json:"nips,omitempty"`
+	Snippet     string            `json:"snippet"`
+}
+
+func (c *invoiceChat) searchInvoices(ctx context.Context, input map[string]interface{}) (string, error) {
+	query := index.Query{}
+	query.Text, _ = input["query"].(string)
+	query.From, _ = input["from"].(string)
+	query.To, _ = input["to"].(string)
+	query.MissingNip, _ = input["missingNip"].(bool)
+	label, _ := input["label"].(string)
+	query.Label = llm.DocumentLabel(label)
+
+	for _, date := range []string{query.From, query.To} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			return "", fmt.Errorf("invalid date %q, use YYYY-MM-DD", date)
+		}
+	}
+
+	limit := DEFAULT_SEARCH_LIMIT
+	if value, ok := input["limit"].(float64); ok && value > 0 {
+		limit = min(int(value), MAX_SEARCH_LIMIT)
+	}
+
+	found := index.Search(c.records, query)
+	result := searchResult{Matches: len(found), Documents: []searchRecord{}}
+	for i, record := range found {
+		if record.GrossTotal != nil || record.NetTotal != nil {
+			result.Totals.Known++
+			result.Totals.Net += value(record.NetTotal)
+			result.Totals.Vat += value(record.VatTotal)
+			result.Totals.Gross += value(record.GrossTotal)
+		}
+
+		if i < limit {
+			result.Documents = append(result.Documents, searchRecord{
+				Path:        record.Path,
+				Label:       record.Label,
+				InvoiceDate: record.InvoiceDate,
+				NetTotal:    record.NetTotal,
+				VatTotal:    record.VatTotal,
+				GrossTotal:  record.GrossTotal,
+				Nips:        record.Nips,
+				Snippet:     record.Snippet(query.Text),
+			})
+		}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	// The snippets are a part of the documents.
+	return llm.Fence(string(data)), nil
+}
+
+func (c *invoiceChat) readInvoice(ctx context.Context, input map[string]interface{}) (string, error) {
+	path, _ := input["path"].(string)
+
+	// Only the indexed documents, the model doesn't get to read any file.
+	record := c.record(path)
+	if record == nil {
+		return "", fmt.Errorf("no document %q in the index, use the path from search_invoices", path)
+	}
+	if strings.TrimSpace(record.Text) == "" {
+		return "The document has no text layer, it's most likely a scan.", nil
+	}
+
+	text := []rune(record.Text)
+	if len(text) > MAX_READ_LENGTH {
+		text = text[:MAX_READ_LENGTH]
+	}
+	return llm.Fence(string(text)), nil
+}
+
+func value(number *float64) float64 {
+	if number == nil {
+		return 0
+	}
+	return *number
+}
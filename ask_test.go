@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/ai/anthropictest"
+	"github.com/krol22/invoice_go_sort_sort/email"
+	"github.com/krol22/invoice_go_sort_sort/index"
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+)
+
+func TestAskCitesIndexedInvoices(t *testing.T) {
+	client, server, icloudPath := setupPipeline(t)
+	server.Enqueue(
+		anthropictest.ToolUse(map[string]interface{}{"label": "vat_invoice"}),
+		anthropictest.ToolUse(map[string]interface{}{
+			"date": "2024-03-15", "dateConfidence": 0.95,
+			"netTotal": 100.0, "vatTotal": 23.0, "grossTotal": 123.0,
+		}),
+	)
+
+	attachment := &email.Attachment{Filename: "faktura.pdf", Content: []byte("%PDF-1.4")}
+	text := unlabelledInvoice + "\nNIP: PL 899-25-36-987"
+	err := analyzeAttachment(context.Background(), client, pdf.NewDocument(text), newEmailMessage(time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)), attachment)
+	if err != nil {
+		t.Fatalf("analyzeAttachment: %v", err)
+	}
+
+	records, err := index.Load()
+	if err != nil {
+		t.Fatalf("index.Load: %v", err)
+	}
+	path := filepath.Join(icloudPath, "Documents/Firma/2024/dokumenty_marzec/faktura.pdf")
+	if len(records) != 1 || records[0].Path != path || records[0].GrossTotal == nil || *records[0].GrossTotal != 123 {
+		t.Fatalf("index = %+v, want the filed invoice with its totals", records)
+	}
+	if !reflect.DeepEqual(records[0].Nips, []string{"8992536987"}) {
+		t.Errorf("nips = %v", records[0].Nips)
+	}
+
+	server.Enqueue(
+		anthropictest.ToolCall("toolu_1", "search_invoices", map[string]interface{}{"query": "ovh", "from": "2024-01-01", "to": "2024-12-31"}),
+		anthropictest.Text("Zapłaciliśmy 123,00 zł.\n\nŹródła:\n- "+path+"\n- /Documents/Firma/2024/zmyslona.pdf"),
+	)
+
+	var out strings.Builder
+	chat, err := newInvoiceChat(client, records, &out)
+	if err != nil {
+		t.Fatalf("newInvoiceChat: %v", err)
+	}
+
+	cited, err := chat.ask(context.Background(), "Ile zapłaciliśmy OVH w 2024?")
+	if err != nil {
+		t.Fatalf("ask: %v", err)
+	}
+
+	if !reflect.DeepEqual(cited, []string{path}) {
+		t.Errorf("cited = %v, want only the indexed invoice", cited)
+	}
+	if !strings.Contains(out.String(), "Zapłaciliśmy 123,00 zł.") {
+		t.Errorf("answer not streamed, got %q", out.String())
+	}
+
+	requests := server.Requests()
+	messages, _ := requests[len(requests)-1].Body["messages"].([]interface{})
+	if len(messages) != 3 {
+		t.Fatalf("got %d messages in the last request, want the question, the call and the result", len(messages))
+	}
+	result, _ := messages[2].(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})["content"].(string)
+	if !strings.Contains(result, path) || !strings.Contains(result, `"gross":123`) || !strings.Contains(result, "<document-") {
+		t.Errorf("search result = %s, want the fenced invoice with the sums", result)
+	}
+}
+
+func TestAskReadsOnlyIndexedInvoices(t *testing.T) {
+	chat := &invoiceChat{records: []index.Record{{Path: "/Firma/2024/faktura.pdf", Text: "FAKTURA <b>"}}}
+
+	text, err := chat.readInvoice(context.Background(), map[string]interface{}{"path": "/Firma/2024/faktura.pdf"})
+	if err != nil || !strings.Contains(text, "FAKTURA &lt;b&gt;") {
+		t.Errorf("readInvoice = %q, %v, want the escaped text", text, err)
+	}
+
+	if _, err := chat.readInvoice(context.Background(), map[string]interface{}{"path": "/etc/passwd"}); err == nil {
+		t.Error("read a file outside of the index")
+	}
+}
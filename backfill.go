@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/ai/llm"
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+)
+
+// runBackfillCommand sorts all the invoices received since the given date,
+// with the AI tasks sent through the Message Batches API at half the price.
+// It doesn't touch the last run of the regular sorting.
+func runBackfillCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: backfill <YYYY-MM-DD>")
+	}
+
+	since, err := time.Parse("2006-01-02", args[0])
+	if err != nil {
+		return fmt.Errorf("invalid date: %v", err)
+	}
+
+	anthropicClient, ledger, err := newAnthropicClient()
+	if err != nil {
+		return err
+	}
+	defer logUsage(ledger)
+
+	passwords, err := pdf.LoadPasswords()
+	if err != nil {
+		return err
+	}
+
+	l.Print("Fetching email invoices since ", args[0], ".")
+	emailMessages, err := getEmailInvoices(since)
+	if err != nil {
+		return err
+	}
+
+	docs := []*invoiceDocument{}
+	for _, emailMessage := range emailMessages {
+		for i := range emailMessage.Attachments {
+			attachment := &emailMessage.Attachments[i]
+			document, err := attachmentDocument(attachment, emailMessage.SenderAddress(), passwords)
+			if err != nil {
+				return err
+			}
+			if document == nil {
+				continue
+			}
+			l.Print("Processing attachment: ", attachment.Filename)
+
+			doc, err := newInvoiceDocument(emailMessage, attachment, document)
+			if err != nil {
+				return err
+			}
+			if doc.locked() {
+				if err := reviewLocked(doc); err != nil {
+					return err
+				}
+				continue
+			}
+			docs = append(docs, doc)
+		}
+	}
+
+	return backfill(ctx, anthropicClient, docs)
+}
+
+// backfill runs the pipeline of analyzeAttachment over all the documents at
+// once, one batch per AI task. A failed document doesn't stop the others.
+func backfill(ctx context.Context, anthropicClient *ai.AnthropicClient, docs []*invoiceDocument) error {
+	failed := 0
+	fail := func(doc *invoiceDocument, err error) error {
+		if ctx.Err() != nil || errors.Is(err, ai.ErrBudgetExceeded) {
+			return err
+		}
+		l.Error().Err(err).Str("filename", doc.attachment.Filename).Msg("Failed to sort the document")
+		failed++
+		return nil
+	}
+
+	l.Print("Classifying ", len(docs), " documents.")
+	classifyTasks := make([]ai.LLM, len(docs))
+	classifyDocuments := make([]*llm.ClassifyDocumentLLM, len(docs))
+	for i, doc := range docs {
+		classifyDocuments[i] = newClassifyDocument(doc)
+		classifyTasks[i] = classifyDocuments[i]
+	}
+
+	results, err := anthropicClient.RunBatch(ctx, classifyTasks)
+	if err != nil {
+		return err
+	}
+
+	toAnalyze := []*invoiceDocument{}
+	// Their parts are merged into a single answer, which RunBatch can't do.
+	chunked := []*invoiceDocument{}
+	for i, doc := range docs {
+		next, err := handleClassification(doc, classifyDocuments[i], results[i].Err)
+		if err != nil {
+			if err := fail(doc, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if !next {
+			continue
+		}
+
+		filed, err := fileByTextDate(doc)
+		if err != nil {
+			if err := fail(doc, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if filed {
+			continue
+		}
+		if doc.chunked() {
+			chunked = append(chunked, doc)
+			continue
+		}
+		toAnalyze = append(toAnalyze, doc)
+	}
+
+	l.Print("Analyzing ", len(toAnalyze), " invoices.")
+	analyzeTasks := make([]ai.LLM, len(toAnalyze))
+	analyzeInvoices := make([]*llm.AnalyzeInvoiceLLM, len(toAnalyze))
+	for i, doc := range toAnalyze {
+		analyzeInvoices[i] = newAnalyzeInvoice(doc)
+		analyzeTasks[i] = analyzeInvoices[i]
+	}
+
+	results, err = anthropicClient.RunBatch(ctx, analyzeTasks)
+	if err != nil {
+		return err
+	}
+
+	for i, doc := range toAnalyze {
+		if err := handleAnalysis(doc, analyzeInvoices[i], results[i].Err); err != nil {
+			if err := fail(doc, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, doc := range chunked {
+		l.Print("Analyzing ", doc.attachment.Filename, " in ", len(doc.parts), " parts.")
+		analyzeInvoice, err := analyzeDocument(ctx, anthropicClient, doc)
+		if err := handleAnalysis(doc, analyzeInvoice, err); err != nil {
+			if err := fail(doc, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to sort %d of %d documents", failed, len(docs))
+	}
+
+	l.Print("Backfilled ", len(docs), " documents.")
+	return nil
+}
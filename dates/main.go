@@ -0,0 +1,243 @@
+package dates
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind of the date, based on the label in front of it.
+type Kind string
+
+const (
+  KIND_ISSUE Kind = "issue"
+  KIND_SALE Kind = "sale"
+)
+
+type Candidate struct {
+  Date time.Time `json:"date"`
+  Kind Kind `json:"kind"`
+  Label string `json:"label"`
+  Score float64 `json:"score"`
+}
+
+type Result struct {
+  Date time.Time `json:"date"`
+  // False when nothing was found or the labelled dates disagree, the LLM has
+  // to decide then.
+  Found bool `json:"found"`
+  // Of the label of the date, 1 for an issue date, less for a sale date.
+  Score float64 `json:"score"`
+  Reason string `json:"reason"`
+  Candidates []Candidate `json:"candidates"`
+}
+
+type label struct {
+  kind Kind
+  score float64
+  pattern *regexp.Regexp
+}
+
+// How far after the label we look for the date, pdf2txt often puts the value
+// a line or two below.
+const LABEL_WINDOW = 80
+
+var labels = []label{
+  {KIND_ISSUE, 1.0, regexp.MustCompile(`(?i)data\s+wystawienia|wystawiono\s+dnia|data\s+faktury`)},
+  {KIND_ISSUE, 1.0, regexp.MustCompile(`(?i)invoice\s+date|date\s+of\s+issue|issue\s+date|date\s+issued|issued\s+on`)},
+  {KIND_ISSUE, 1.0, regexp.MustCompile(`(?i)rechnungsdatum|ausstellungsdatum|datum\s+der\s+rechnung`)},
+  {KIND_SALE, 0.6, regexp.MustCompile(`(?i)data\s+sprzeda[żz]y|data\s+dostawy|data\s+wykonania\s+us[łl]ugi`)},
+  {KIND_SALE, 0.6, regexp.MustCompile(`(?i)sale\s+date|date\s+of\s+sale|delivery\s+date|date\s+of\s+supply`)},
+  {KIND_SALE, 0.6, regexp.MustCompile(`(?i)leistungsdatum|lieferdatum`)},
+}
+
+var months = func() map[string]time.Month {
+  names := map[time.Month][]string{
+    time.January: {"stycznia", "styczeń", "january", "jan", "januar"},
+    time.February: {"lutego", "luty", "february", "feb", "februar"},
+    time.March: {"marca", "marzec", "march", "mar", "märz", "maerz"},
+    time.April: {"kwietnia", "kwiecień", "april", "apr"},
+    time.May: {"maja", "maj", "may", "mai"},
+    time.June: {"czerwca", "czerwiec", "june", "jun", "juni"},
+    time.July: {"lipca", "lipiec", "july", "jul", "juli"},
+    time.August: {"sierpnia", "sierpień", "august", "aug"},
+    time.September: {"września", "wrzesień", "september", "sep", "sept"},
+    time.October: {"października", "październik", "october", "oct", "oktober", "okt"},
+    time.November: {"listopada", "listopad", "november", "nov"},
+    time.December: {"grudnia", "grudzień", "december", "dec", "dezember", "dez"},
+  }
+
+  months := map[string]time.Month{}
+  for month, monthNames := range names {
+    for _, name := range monthNames {
+      months[name] = month
+    }
+  }
+  return months
+}()
+
+var monthPattern = func() string {
+  var names []string
+  for name := range months {
+    names = append(names, regexp.QuoteMeta(name))
+  }
+  // Longest first, so "marca" wins over "mar".
+  sort.Slice(names, func(i, j int) bool {
+    return len(names[i]) > len(names[j])
+  })
+  return strings.Join(names, "|")
+}()
+
+var (
+  yearFirst = regexp.MustCompile(`\b(\d{4})[-./](\d{1,2})[-./](\d{1,2})\b`)
+  dayFirst = regexp.MustCompile(`\b(\d{1,2})[-./](\d{1,2})[-./](\d{4})\b`)
+  dayMonthName = regexp.MustCompile(`(?i)\b(\d{1,2})\.?\s+(` + monthPattern + `)\.?\s+(\d{4})`)
+  monthNameDay = regexp.MustCompile(`(?i)\b(` + monthPattern + `)\.?\s+(\d{1,2}),?\s+(\d{4})`)
+)
+
+func newDate(year int, month int, day int) (time.Time, bool) {
+  if month < 1 || month > 12 || day < 1 || day > 31 {
+    return time.Time{}, false
+  }
+
+  date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+  // time.Date normalizes 31.02 into March, we don't want that.
+  if date.Day() != day {
+    return time.Time{}, false
+  }
+  return date, true
+}
+
+type match struct {
+  date time.Time
+  start int
+}
+
+// findDates returns all the dates in the text, in the order they appear.
+func findDates(text string) []match {
+  var matches []match
+  atoi := func(s string) int {
+    n, _ := strconv.Atoi(s)
+    return n
+  }
+
+  for _, m := range yearFirst.FindAllStringSubmatchIndex(text, -1) {
+    if date, ok := newDate(atoi(text[m[2]:m[3]]), atoi(text[m[4]:m[5]]), atoi(text[m[6]:m[7]])); ok {
+      matches = append(matches, match{date, m[0]})
+    }
+  }
+
+  for _, m := range dayFirst.FindAllStringSubmatchIndex(text, -1) {
+    day, month, year := atoi(text[m[2]:m[3]]), atoi(text[m[4]:m[5]]), atoi(text[m[6]:m[7]])
+    date, ok := newDate(year, month, day)
+    if !ok {
+      // US style 03/15/2024.
+      date, ok = newDate(year, day, month)
+    }
+    if ok {
+      matches = append(matches, match{date, m[0]})
+    }
+  }
+
+  for _, m := range dayMonthName.FindAllStringSubmatchIndex(text, -1) {
+    month := months[strings.ToLower(text[m[4]:m[5]])]
+    if date, ok := newDate(atoi(text[m[6]:m[7]]), int(month), atoi(text[m[2]:m[3]])); ok {
+      matches = append(matches, match{date, m[0]})
+    }
+  }
+
+  for _, m := range monthNameDay.FindAllStringSubmatchIndex(text, -1) {
+    month := months[strings.ToLower(text[m[2]:m[3]])]
+    if date, ok := newDate(atoi(text[m[6]:m[7]]), int(month), atoi(text[m[4]:m[5]])); ok {
+      matches = append(matches, match{date, m[0]})
+    }
+  }
+
+  sort.Slice(matches, func(i, j int) bool {
+    return matches[i].start < matches[j].start
+  })
+
+  return matches
+}
+
+// All returns every date in the text, labelled or not, in the order they
+// appear.
+func All(text string) []time.Time {
+  matches := findDates(text)
+
+  all := make([]time.Time, len(matches))
+  for i, m := range matches {
+    all[i] = m.date
+  }
+  return all
+}
+
+// Extract returns the dates that have a known label in front of them.
+func Extract(text string) []Candidate {
+  dates := findDates(text)
+
+  var candidates []Candidate
+  for _, label := range labels {
+    for _, m := range label.pattern.FindAllStringIndex(text, -1) {
+      for _, date := range dates {
+        if date.start < m[1] {
+          continue
+        }
+        if date.start-m[1] <= LABEL_WINDOW {
+          candidates = append(candidates, Candidate{
+            Date: date.date,
+            Kind: label.kind,
+            Label: text[m[0]:m[1]],
+            Score: label.score,
+          })
+        }
+        break
+      }
+    }
+  }
+
+  return candidates
+}
+
+// Find picks the issue date: the date with the best label wins. The sale
+// date can legitimately differ from the issue date, so it only counts when
+// there is no issue date, at its lower score. Gives up when the best labelled
+// dates disagree.
+func Find(text string) *Result {
+  result := &Result{
+    Candidates: Extract(text),
+  }
+
+  best := map[time.Time]Candidate{}
+  for _, candidate := range result.Candidates {
+    if candidate.Score > best[candidate.Date].Score {
+      best[candidate.Date] = candidate
+    }
+  }
+
+  var winners []Candidate
+  for _, candidate := range best {
+    switch {
+    case len(winners) == 0 || candidate.Score > winners[0].Score:
+      winners = []Candidate{candidate}
+    case candidate.Score == winners[0].Score:
+      winners = append(winners, candidate)
+    }
+  }
+
+  switch len(winners) {
+  case 0:
+    result.Reason = "no labelled date"
+  case 1:
+    result.Date = winners[0].Date
+    result.Score = winners[0].Score
+    result.Found = true
+    result.Reason = "labelled " + string(winners[0].Kind) + " date"
+  default:
+    result.Reason = "labelled " + string(winners[0].Kind) + " dates disagree"
+  }
+
+  return result
+}
@@ -0,0 +1,111 @@
+package dates_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/dates"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+  return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestAllFormats(t *testing.T) {
+  cases := []struct {
+    name string
+    text string
+    want []time.Time
+  }{
+    {"iso", "Termin: 2024-03-15", []time.Time{date(2024, 3, 15)}},
+    {"iso dotted", "2024.03.05", []time.Time{date(2024, 3, 5)}},
+    {"dotted", "Warszawa, 15.03.2024 r.", []time.Time{date(2024, 3, 15)}},
+    {"slashed", "15/03/2024", []time.Time{date(2024, 3, 15)}},
+    {"dashed", "5-3-2024", []time.Time{date(2024, 3, 5)}},
+    {"us style", "03/15/2024", []time.Time{date(2024, 3, 15)}},
+    // Day first when both fit.
+    {"ambiguous", "01/02/2024", []time.Time{date(2024, 2, 1)}},
+    {"polish month", "15 marca 2024", []time.Time{date(2024, 3, 15)}},
+    {"polish nominative", "1 luty 2024", []time.Time{date(2024, 2, 1)}},
+    {"english month", "March 15, 2024", []time.Time{date(2024, 3, 15)}},
+    {"german month", "15. März 2024", []time.Time{date(2024, 3, 15)}},
+    {"abbreviated month", "15 Mar. 2024", []time.Time{date(2024, 3, 15)}},
+    {"in order", "2024-03-31 i 1.04.2024", []time.Time{date(2024, 3, 31), date(2024, 4, 1)}},
+    {"no such day", "31.02.2024 2024-13-01", []time.Time{}},
+    {"no date", "FV 1/03/24", []time.Time{}},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      got := dates.All(c.text)
+      if len(got) == 0 && len(c.want) == 0 {
+        return
+      }
+      if !reflect.DeepEqual(got, c.want) {
+        t.Errorf("All(%q) = %v, want %v", c.text, got, c.want)
+      }
+    })
+  }
+}
+
+func TestFindPicksIssueDate(t *testing.T) {
+  cases := []struct {
+    name string
+    text string
+    found bool
+    date time.Time
+    score float64
+    reason string
+  }{
+    {
+      name: "issue date",
+      text: "Data wystawienia: 2024-03-15\nData sprzedaży: 2024-02-29",
+      found: true, date: date(2024, 3, 15), score: 1, reason: "labelled issue date",
+    },
+    {
+      name: "value below the label",
+      text: "Invoice date\n\nMarch 15, 2024",
+      found: true, date: date(2024, 3, 15), score: 1, reason: "labelled issue date",
+    },
+    {
+      name: "issue date repeated",
+      text: "Rechnungsdatum: 15.03.2024\n...\nRechnungsdatum 15.03.2024",
+      found: true, date: date(2024, 3, 15), score: 1, reason: "labelled issue date",
+    },
+    {
+      name: "sale date only",
+      text: "Data sprzedaży: 29 lutego 2024",
+      found: true, date: date(2024, 2, 29), score: 0.6, reason: "labelled sale date",
+    },
+    {
+      name: "issue dates disagree",
+      text: "Data wystawienia: 2024-03-15\nIssue date: 2024-03-16",
+      reason: "labelled issue dates disagree",
+    },
+    {
+      name: "sale dates disagree",
+      text: "Data sprzedaży: 2024-03-15\nDelivery date: 2024-03-16",
+      reason: "labelled sale dates disagree",
+    },
+    {
+      name: "unlabelled",
+      text: "Termin płatności: 2024-03-29",
+      reason: "no labelled date",
+    },
+    {
+      name: "too far from the label",
+      text: "Data wystawienia:" + string(make([]byte, dates.LABEL_WINDOW + 1)) + "2024-03-15",
+      reason: "no labelled date",
+    },
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      result := dates.Find(c.text)
+      if result.Found != c.found || !result.Date.Equal(c.date) || result.Score != c.score || result.Reason != c.reason {
+        t.Errorf("Find = %v %v %v %q, want %v %v %v %q", result.Found, result.Date, result.Score, result.Reason, c.found, c.date, c.score, c.reason)
+      }
+    })
+  }
+}
@@ -0,0 +1,75 @@
+package email
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// The beginning of the body is what the sender wrote, the rest are usually
+// quotes, footers and legal notes.
+const MAX_BODY_LENGTH = 2000
+
+var (
+	htmlHiddenPattern = regexp.MustCompile(`(?is)<(style|script|head)\b.*?</(style|script|head)>`)
+	htmlBreakPattern  = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li|/h[1-6])\b[^>]*>`)
+	htmlTagPattern    = regexp.MustCompile(`<[^>]*>`)
+	blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlText turns an HTML body into plain text, for the emails that come
+// without a plain text part.
+func htmlText(body string) string {
+	body = htmlHiddenPattern.ReplaceAllString(body, "")
+	body = htmlBreakPattern.ReplaceAllString(body, "\n")
+	body = htmlTagPattern.ReplaceAllString(body, "")
+	return html.UnescapeString(body)
+}
+
+// TrimBody leaves what the sender wrote: without the quoted replies and the
+// signature, with the blank lines squeezed, cut to maxLength characters.
+// Forwarded messages are kept, they are the interesting part of a forward.
+func TrimBody(body string, maxLength int) string {
+	lines := []string{}
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		// &nbsp; from the HTML bodies too.
+		line = strings.TrimRight(line, " \t\u00a0")
+		if line == "--" {
+			break
+		}
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	trimmed := strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+
+	runes := []rune(trimmed)
+	if len(runes) > maxLength {
+		return strings.TrimSpace(string(runes[:maxLength])) + "…"
+	}
+	return trimmed
+}
+
+// SenderAddress is the address alone, lower case, e.g. to look up the
+// password of the sender.
+func (m *EmailMessage) SenderAddress() string {
+	if m.Message == nil || m.Message.Envelope == nil || len(m.Message.Envelope.From) == 0 {
+		return ""
+	}
+	return strings.ToLower(m.Message.Envelope.From[0].Address())
+}
+
+// Sender is the name and the address of the first sender.
+func (m *EmailMessage) Sender() string {
+	if m.Message == nil || m.Message.Envelope == nil || len(m.Message.Envelope.From) == 0 {
+		return ""
+	}
+
+	from := m.Message.Envelope.From[0]
+	if from.PersonalName == "" {
+		return from.Address()
+	}
+	return from.PersonalName + " <" + from.Address() + ">"
+}
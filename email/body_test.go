@@ -0,0 +1,61 @@
+package email
+
+import "testing"
+
+func TestTrimBody(t *testing.T) {
+	cases := []struct {
+		name      string
+		body      string
+		maxLength int
+		want      string
+	}{
+		{"plain", "W załączniku faktura za marzec.", 100, "W załączniku faktura za marzec."},
+		{"crlf and trailing spaces", "Dzień dobry, \r\nfaktura w załączniku. \r\n", 100, "Dzień dobry,\nfaktura w załączniku."},
+		{"quoted reply", "Przesyłam fakturę.\n> Proszę o fakturę.\n>> Dzień dobry", 100, "Przesyłam fakturę."},
+		{"signature", "Faktura w załączniku.\n--\nJan Kowalski\ntel. 600 000 000", 100, "Faktura w załączniku."},
+		// Only the exact separator, a line of dashes is a part of the text.
+		{"dashes", "Faktura\n-----\nRazem: 123,00 zł", 100, "Faktura\n-----\nRazem: 123,00 zł"},
+		{"blank lines", "\n\nFaktura\n\n\n\n\nza marzec\n\n", 100, "Faktura\n\nza marzec"},
+		{"forward kept", "---------- Forwarded message ---------\nFrom: OVH\n\nFaktura nr 1/03/2024", 100, "---------- Forwarded message ---------\nFrom: OVH\n\nFaktura nr 1/03/2024"},
+		{"cut by runes", "Zażółć gęślą jaźń", 6, "Zażółć…"},
+		{"cut before a space", "Faktura za marzec", 8, "Faktura…"},
+		{"exactly the limit", "Zażółć", 6, "Zażółć"},
+		{"empty", "\n\n", 100, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := TrimBody(c.body, c.maxLength); got != c.want {
+				t.Errorf("TrimBody(%q, %d) = %q, want %q", c.body, c.maxLength, got, c.want)
+			}
+		})
+	}
+}
+
+func TestHtmlText(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"tags", "<p>Faktura <b>w załączniku</b></p>", "Faktura w załączniku\n"},
+		{"breaks", "<div>Dzień dobry,<br>faktura<BR/>za marzec</div><div>OVH</div>", "Dzień dobry,\nfaktura\nza marzec\nOVH\n"},
+		{"hidden", "<head><title>Faktura</title></head><style>p { color: red }</style><script>alert(1)</script>Treść", "Treść"},
+		{"entities", "Razem:&nbsp;123,00&nbsp;zł &amp; VAT", "Razem: 123,00 zł & VAT"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := htmlText(c.body); got != c.want {
+				t.Errorf("htmlText(%q) = %q, want %q", c.body, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTrimBodyOfHtml(t *testing.T) {
+	body := htmlText("<div>Faktura w załączniku.&nbsp;</div><div><br></div><div><br></div><div><br></div><div>--</div><div>Jan Kowalski</div>")
+	if got, want := TrimBody(body, 100), "Faktura w załączniku."; got != want {
+		t.Errorf("TrimBody(htmlText(...)) = %q, want %q", got, want)
+	}
+}
@@ -3,6 +3,7 @@ package email
 import (
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -18,6 +19,9 @@ var l = log.Get()
 type EmailMessage struct {
 	Message *imap.Message
 	Attachments []Attachment
+	// The plain text part, or the HTML one turned into text when there's no
+	// plain text.
+	Body string
 }
 
 type Attachment struct {
@@ -134,6 +138,7 @@ func (e *EmailManager) processMessage(msg *imap.Message) (*EmailMessage, error)
 			return nil, fmt.Errorf("failed to get raw message body")
 	}
 
+	var plainBody, htmlBody strings.Builder
 	for _, part := range msg.Body {
 		mr, err := mail.CreateReader(part)
 		if err != nil {
@@ -164,9 +169,27 @@ func (e *EmailManager) processMessage(msg *imap.Message) (*EmailMessage, error)
 					Content:  content,
 				}
 				emailMsg.Attachments = append(emailMsg.Attachments, attachment)
+			case *mail.InlineHeader:
+				contentType, _, _ := h.ContentType()
+				content, err := io.ReadAll(p.Body)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read message body: %v", err)
+				}
+
+				switch contentType {
+				case "text/plain":
+					plainBody.Write(content)
+				case "text/html":
+					htmlBody.Write(content)
+				}
 			}
 		}
 	}
 
+	emailMsg.Body = plainBody.String()
+	if strings.TrimSpace(emailMsg.Body) == "" {
+		emailMsg.Body = htmlText(htmlBody.String())
+	}
+
 	return emailMsg, nil
 }
@@ -13,6 +13,34 @@ var (
     ApiKey            string
     AnthropicKey      string
     AnthropicVersion  string
+    AnthropicBaseUrl  string
+    AnthropicModel    string
+    AnthropicMaxTokens string
+    AnthropicTemperature string
+    AnthropicTimeout  string
+    AnthropicTasks    string
+    CacheDir          string
+    CacheTtl          string
+    CacheMaxSize      string
+    AnthropicPrices   string
+    AiMonthlyBudget   string
+    AiMaxAttempts     string
+    ReviewConfidenceThreshold string
+    PromptsDir string
+    AnthropicMaxRetries string
+    AnthropicBatchPollInterval string
+    AnthropicRoutes string
+    AnthropicRouteCompare string
+    AiEscalationThreshold string
+    AiMaxDocumentTokens string
+    AiLongDocumentStrategy string
+    PdfExtractor string
+    PdfExtractorPath string
+    PdfOcr string
+    TesseractPath string
+    PdftoppmPath string
+    PdfArchiveCleanup string
+    PdfArchiveDecrypted string
     PushoverApiToken  string
     PushoverUserKey   string
 )
@@ -39,6 +67,62 @@ func Get(key string) string {
     return AnthropicKey
   case "ANTHROPIC_VERSION":
     return AnthropicVersion
+  case "ANTHROPIC_BASE_URL":
+    return AnthropicBaseUrl
+  case "ANTHROPIC_MODEL":
+    return AnthropicModel
+  case "ANTHROPIC_MAX_TOKENS":
+    return AnthropicMaxTokens
+  case "ANTHROPIC_TEMPERATURE":
+    return AnthropicTemperature
+  case "ANTHROPIC_TIMEOUT":
+    return AnthropicTimeout
+  case "ANTHROPIC_TASKS":
+    return AnthropicTasks
+  case "CACHE_DIR":
+    return CacheDir
+  case "CACHE_TTL":
+    return CacheTtl
+  case "CACHE_MAX_SIZE":
+    return CacheMaxSize
+  case "ANTHROPIC_PRICES":
+    return AnthropicPrices
+  case "AI_MONTHLY_BUDGET":
+    return AiMonthlyBudget
+  case "AI_MAX_ATTEMPTS":
+    return AiMaxAttempts
+  case "REVIEW_CONFIDENCE_THRESHOLD":
+    return ReviewConfidenceThreshold
+  case "PROMPTS_DIR":
+    return PromptsDir
+  case "ANTHROPIC_MAX_RETRIES":
+    return AnthropicMaxRetries
+  case "ANTHROPIC_BATCH_POLL_INTERVAL":
+    return AnthropicBatchPollInterval
+  case "ANTHROPIC_ROUTES":
+    return AnthropicRoutes
+  case "ANTHROPIC_ROUTE_COMPARE":
+    return AnthropicRouteCompare
+  case "AI_ESCALATION_THRESHOLD":
+    return AiEscalationThreshold
+  case "AI_MAX_DOCUMENT_TOKENS":
+    return AiMaxDocumentTokens
+  case "AI_LONG_DOCUMENT_STRATEGY":
+    return AiLongDocumentStrategy
+  case "PDF_EXTRACTOR":
+    return PdfExtractor
+  case "PDF_EXTRACTOR_PATH":
+    return PdfExtractorPath
+  case "PDF_OCR":
+    return PdfOcr
+  case "TESSERACT_PATH":
+    return TesseractPath
+  case "PDFTOPPM_PATH":
+    return PdftoppmPath
+  case "PDF_ARCHIVE_CLEANUP":
+    return PdfArchiveCleanup
+  case "PDF_ARCHIVE_DECRYPTED":
+    return PdfArchiveDecrypted
   case "PUSHOVER_API_TOKEN":
     return PushoverApiToken
   case "PUSHOVER_USER_KEY":
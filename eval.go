@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/ai/llm"
+	"github.com/krol22/invoice_go_sort_sort/env"
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+	"github.com/krol22/invoice_go_sort_sort/workspace"
+)
+
+const evalUsage = `usage: eval [-config a.env] [-compare b.env] [-replay dir | -record dir] <dataset>
+
+The dataset is a folder of documents (<name>.txt or <name>.pdf), each with the
+expected output in <name>.json, e.g. {"label": "vat_invoice", "date": "2024-03-15"}.
+Optional "receivedAt" and "email" ({"subject", "from", "body"}) are passed to
+the analysis, like the email the invoice came with.`
+
+// Fields compared against the expected output, the label comes from the
+// classification and the rest from the invoice analysis.
+var evalFields = []string{"label", "date", "netTotal", "vatTotal", "grossTotal"}
+
+type evalCase struct {
+	Name string
+	Text string
+	Pdf  []byte
+	// The text of a scan, read by OCR.
+	OCR      bool
+	Expected map[string]interface{}
+}
+
+type evalClient struct {
+	*ai.AnthropicClient
+	// Counts only the requests of this evaluation.
+	Ledger *ai.UsageLedger
+}
+
+type evalStats struct {
+	Correct int
+	Total   int
+}
+
+type evalReport struct {
+	Config string
+	Cases  int
+	Errors int
+	Fields map[string]*evalStats
+	// expected label -> answered label -> count
+	Labels map[string]map[string]int
+	Dates  map[string]int
+	Usage  ai.UsageTotals
+}
+
+func runEvalCommand(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	configPath := flags.String("config", "", "env file with the settings to evaluate")
+	comparePath := flags.String("compare", "", "env file with the settings to compare with")
+	replayDir := flags.String("replay", "", "serve the recorded responses from the folder, no network")
+	recordDir := flags.String("record", "", "record the responses into the folder")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), evalUsage)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || (*replayDir != "" && *recordDir != "") {
+		return fmt.Errorf(evalUsage)
+	}
+
+	cases, err := loadEvalCases(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	l.Print("Loaded ", len(cases), " evaluation cases.")
+
+	configPaths := []string{*configPath}
+	if *comparePath != "" {
+		configPaths = append(configPaths, *comparePath)
+	}
+
+	var reports []*evalReport
+	for _, path := range configPaths {
+		client, err := newEvalClient(path, *replayDir, *recordDir)
+		if err != nil {
+			return err
+		}
+
+		report := runEval(ctx, client, cases)
+		report.Config = path
+		if report.Config == "" {
+			report.Config = "default"
+		}
+		reports = append(reports, report)
+	}
+	llm.PromptsDir = ""
+
+	printEvalReports(out, reports)
+	return nil
+}
+
+// newEvalClient builds the client from the env file on top of the current
+// environment. It doesn't use the cache, every case is asked for real (or
+// replayed).
+func newEvalClient(configPath string, replayDir string, recordDir string) (*evalClient, error) {
+	overrides := map[string]string{}
+	if configPath != "" {
+		var err error
+		overrides, err = godotenv.Read(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", configPath, err)
+		}
+	}
+
+	lookup := func(key string) string {
+		if value, ok := overrides[key]; ok {
+			return value
+		}
+		return env.Get(key)
+	}
+
+	aiConfig, err := ai.ConfigFromLookup(lookup)
+	if err != nil {
+		return nil, err
+	}
+	llm.PromptsDir = lookup("PROMPTS_DIR")
+
+	ledger := ai.NewUsageLedger()
+	options := []ai.ClientOption{
+		ai.WithConfig(aiConfig),
+		ai.WithUsageLedger(ledger),
+	}
+	if replayDir != "" {
+		options = append(options, ai.WithTransport(ai.NewReplayTransport(replayDir, false)))
+	}
+	if recordDir != "" {
+		options = append(options, ai.WithTransport(ai.NewReplayTransport(recordDir, true)))
+	}
+
+	return &evalClient{
+		AnthropicClient: ai.NewClient(lookup("ANTHROPIC_KEY"), options...),
+		Ledger:          ledger,
+	}, nil
+}
+
+func loadEvalCases(dir string) ([]*evalCase, error) {
+	expectedFiles, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(expectedFiles)
+
+	var cases []*evalCase
+	for _, expectedFile := range expectedFiles {
+		base := strings.TrimSuffix(expectedFile, ".json")
+		c := &evalCase{
+			Name: filepath.Base(base),
+		}
+
+		data, err := os.ReadFile(expectedFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", expectedFile, err)
+		}
+		if err := json.Unmarshal(data, &c.Expected); err != nil {
+			return nil, fmt.Errorf("error unmarshalling %s: %v", expectedFile, err)
+		}
+
+		if text, err := os.ReadFile(base + ".txt"); err == nil {
+			c.Text = string(text)
+		} else if pdf, err := os.ReadFile(base + ".pdf"); err == nil {
+			c.Pdf = pdf
+			document, err := readEvalPDF(base + ".pdf")
+			if err != nil {
+				l.Error().Err(err).Str("case", c.Name).Msg("Couldn't extract the text, using the PDF only")
+			} else {
+				c.Text, c.OCR = document.Text(), document.OCR()
+			}
+		} else {
+			return nil, fmt.Errorf("no %s.txt or %s.pdf for %s", c.Name, c.Name, expectedFile)
+		}
+
+		cases = append(cases, c)
+	}
+
+	return cases, nil
+}
+
+// readEvalPDF reads the PDF of the case the way the sorting does, in a
+// workspace of its own.
+func readEvalPDF(path string) (*pdf.Document, error) {
+	ws, err := workspace.New()
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Close()
+
+	return extractTextFromPDF(path, ws.Dir())
+}
+
+func runEval(ctx context.Context, client *evalClient, cases []*evalCase) *evalReport {
+	report := &evalReport{
+		Cases:  len(cases),
+		Fields: map[string]*evalStats{},
+		Labels: map[string]map[string]int{},
+		Dates:  map[string]int{},
+	}
+	for _, field := range evalFields {
+		report.Fields[field] = &evalStats{}
+	}
+
+	for _, c := range cases {
+		if ctx.Err() != nil {
+			break
+		}
+
+		got, err := evalCaseOutput(ctx, client.AnthropicClient, c)
+		if err != nil {
+			l.Error().Err(err).Str("case", c.Name).Msg("Evaluation case failed")
+			report.Errors++
+		}
+
+		for _, field := range evalFields {
+			expected, ok := c.Expected[field]
+			if !ok {
+				continue
+			}
+
+			stats := report.Fields[field]
+			stats.Total++
+			if evalEqual(expected, got[field]) {
+				stats.Correct++
+			}
+		}
+
+		if expected, ok := c.Expected["label"].(string); ok {
+			answered, _ := got["label"].(string)
+			if answered == "" {
+				answered = "-"
+			}
+			if report.Labels[expected] == nil {
+				report.Labels[expected] = map[string]int{}
+			}
+			report.Labels[expected][answered]++
+		}
+
+		if expected, ok := c.Expected["date"].(string); ok {
+			answered, _ := got["date"].(string)
+			report.Dates[compareDates(expected, answered)]++
+		}
+	}
+
+	report.Usage = client.Ledger.Run()
+	return report
+}
+
+// evalCaseOutput runs the tasks the case has expectations for and merges
+// their outputs.
+func evalCaseOutput(ctx context.Context, client *ai.AnthropicClient, c *evalCase) (map[string]interface{}, error) {
+	output := map[string]interface{}{}
+	short := len(strings.TrimSpace(c.Text)) < MIN_TEXT_LENGTH
+
+	if _, ok := c.Expected["label"]; ok {
+		input := &llm.ClassifyDocumentLLMInput{
+			Filename: c.Name,
+			Document: c.Text,
+		}
+		if short {
+			input.Pdf = c.Pdf
+		}
+
+		classifyDocument := llm.NewClassifyDocumentLLM(input)
+		_, err := client.RunLLM(ctx, classifyDocument)
+		if err != nil && !isValidationError(err) {
+			return output, err
+		}
+		output["label"] = string(classifyDocument.GetOutput().Label)
+	}
+
+	input := &llm.AnalyzeInvoiceLLMInput{
+		Invoice: c.Text,
+	}
+	if short {
+		input.Document = c.Pdf
+	} else {
+		input.OCR = c.OCR
+	}
+	if receivedAt, ok := c.Expected["receivedAt"].(string); ok {
+		input.ReceivedAt, _ = time.Parse("2006-01-02", receivedAt)
+	}
+	if emailContext, ok := c.Expected["email"].(map[string]interface{}); ok {
+		input.Email = &llm.EmailContext{}
+		input.Email.Subject, _ = emailContext["subject"].(string)
+		input.Email.From, _ = emailContext["from"].(string)
+		input.Email.Body, _ = emailContext["body"].(string)
+	}
+
+	analyzeInvoice := llm.NewAnalyzeInvoiceLLM(input)
+	_, err := client.RunLLM(ctx, analyzeInvoice)
+	if err != nil && !isValidationError(err) {
+		return output, err
+	}
+
+	if response := analyzeInvoice.GetAiResponse(); response != nil {
+		for key, value := range response.JsonOutput {
+			output[key] = value
+		}
+	}
+
+	return output, nil
+}
+
+// Invalid answers still count, as wrong ones.
+func isValidationError(err error) bool {
+	var validationErr *ai.ValidationError
+	return errors.As(err, &validationErr)
+}
+
+func evalEqual(expected interface{}, got interface{}) bool {
+	switch expected := expected.(type) {
+	case float64:
+		got, ok := got.(float64)
+		return ok && math.Abs(expected-got) < 0.01
+	default:
+		return expected == got
+	}
+}
+
+func compareDates(expected string, answered string) string {
+	if answered == "" {
+		return "missing"
+	}
+
+	expectedDate, err := time.Parse("2006-01-02", expected)
+	if err != nil {
+		return "bad expectation"
+	}
+	answeredDate, err := time.Parse("2006-01-02", answered)
+	if err != nil {
+		return "invalid"
+	}
+
+	switch {
+	case expectedDate.Equal(answeredDate):
+		return "correct"
+	case expectedDate.Year() != answeredDate.Year():
+		return "wrong year"
+	case expectedDate.Month() != answeredDate.Month():
+		// The invoice lands in the wrong folder.
+		return "wrong month"
+	default:
+		return "wrong day"
+	}
+}
+
+func printEvalReports(out io.Writer, reports []*evalReport) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	row := func(name string, value func(r *evalReport) string) {
+		cells := []string{name}
+		for _, report := range reports {
+			cells = append(cells, value(report))
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+
+	row("", func(r *evalReport) string { return r.Config })
+	row("cases", func(r *evalReport) string { return fmt.Sprint(r.Cases) })
+	row("errors", func(r *evalReport) string { return fmt.Sprint(r.Errors) })
+
+	fmt.Fprintln(w, "\t")
+	for _, field := range evalFields {
+		row(field, func(r *evalReport) string {
+			stats := r.Fields[field]
+			if stats.Total == 0 {
+				return "-"
+			}
+			return fmt.Sprintf("%.1f%% (%d/%d)", 100*float64(stats.Correct)/float64(stats.Total), stats.Correct, stats.Total)
+		})
+	}
+
+	fmt.Fprintln(w, "\t")
+	for _, outcome := range collectKeys(reports, func(r *evalReport) map[string]int { return r.Dates }) {
+		row("date: "+outcome, func(r *evalReport) string { return fmt.Sprint(r.Dates[outcome]) })
+	}
+
+	fmt.Fprintln(w, "\t")
+	for _, expected := range collectKeys(reports, func(r *evalReport) map[string]int {
+		keys := map[string]int{}
+		for label := range r.Labels {
+			keys[label] = 1
+		}
+		return keys
+	}) {
+		row("label: "+expected, func(r *evalReport) string {
+			var answers []string
+			for _, answered := range collectKeys([]*evalReport{r}, func(r *evalReport) map[string]int { return r.Labels[expected] }) {
+				answers = append(answers, fmt.Sprintf("%s=%d", answered, r.Labels[expected][answered]))
+			}
+			return strings.Join(answers, " ")
+		})
+	}
+
+	fmt.Fprintln(w, "\t")
+	row("requests", func(r *evalReport) string { return fmt.Sprint(r.Usage.Requests) })
+	row("tokens in/out", func(r *evalReport) string { return fmt.Sprintf("%d/%d", r.Usage.InputTokens, r.Usage.OutputTokens) })
+	row("cost", func(r *evalReport) string { return fmt.Sprintf("$%.4f", r.Usage.Cost) })
+}
+
+func collectKeys(reports []*evalReport, values func(r *evalReport) map[string]int) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, report := range reports {
+		for key := range values(report) {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
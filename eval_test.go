@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/krol22/invoice_go_sort_sort/ai/anthropictest"
+)
+
+var updateEval = flag.Bool("update-eval", false, "record testdata/eval/recordings again, from the answers scripted in the test")
+
+func TestEvalReplaysRecordings(t *testing.T) {
+	t.Setenv("ENV", "development")
+	// The recordings are keyed by the requests, the defaults have to make them.
+	for _, key := range []string{"PROMPTS_DIR", "ANTHROPIC_MODEL", "ANTHROPIC_MAX_TOKENS", "ANTHROPIC_TEMPERATURE", "ANTHROPIC_TASKS", "ANTHROPIC_ROUTES", "ANTHROPIC_ROUTE_COMPARE", "ANTHROPIC_BASE_URL", "AI_MAX_ATTEMPTS"} {
+		t.Setenv(key, "")
+	}
+
+	recordings := filepath.Join("testdata", "eval", "recordings")
+	args := []string{"-replay", recordings, filepath.Join("testdata", "eval", "dataset")}
+	if *updateEval {
+		server := anthropictest.NewServer()
+		defer server.Close()
+		t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+		// The cases in order: orange, then ovh.
+		server.Enqueue(
+			anthropictest.ToolUse(map[string]interface{}{"label": "bill"}),
+			// The end of the billing period, not the issue date.
+			anthropictest.ToolUse(map[string]interface{}{"date": "2024-02-29", "dateConfidence": 0.7, "grossTotal": 49.99}),
+			anthropictest.ToolUse(map[string]interface{}{"label": "receipt"}),
+			anthropictest.ToolUse(map[string]interface{}{"date": "2024-03-15", "dateConfidence": 0.95, "netTotal": 100, "vatTotal": 23, "grossTotal": 123}),
+		)
+
+		if err := os.RemoveAll(recordings); err != nil {
+			t.Fatal(err)
+		}
+		args[0] = "-record"
+	}
+
+	var out strings.Builder
+	if err := runEvalCommand(context.Background(), args, &out); err != nil {
+		t.Fatalf("runEvalCommand: %v", err)
+	}
+
+	for _, want := range []string{
+		`cases +2`,
+		`errors +0`,
+		`label +50\.0% \(1/2\)`,
+		`date +50\.0% \(1/2\)`,
+		`netTotal +100\.0% \(1/1\)`,
+		`vatTotal +100\.0% \(1/1\)`,
+		`grossTotal +100\.0% \(2/2\)`,
+		`date: correct +1`,
+		`date: wrong month +1`,
+		`label: bill +bill=1`,
+		`label: vat_invoice +receipt=1`,
+		`requests +4`,
+	} {
+		if !regexp.MustCompile(`(?m)^` + want + ` *$`).MatchString(out.String()) {
+			t.Errorf("report has no line %q:\n%s", want, out.String())
+		}
+	}
+}
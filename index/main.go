@@ -0,0 +1,188 @@
+// Package index keeps a record of every filed document, with its text, so the
+// archive can be searched without opening the PDFs.
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/krol22/invoice_go_sort_sort/ai/llm"
+	"github.com/krol22/invoice_go_sort_sort/env"
+	"github.com/krol22/invoice_go_sort_sort/log"
+)
+
+var l = log.Get()
+
+// Next to the archive, so it's synced with it.
+const FILE = "_indeks.json"
+
+const SNIPPET_LENGTH = 200
+
+type Record struct {
+  Path string `json:"path"`
+  Label llm.DocumentLabel `json:"label"`
+  InvoiceDate string `json:"invoiceDate"`
+  // Only when the model read the invoice, the date found in the text is
+  // enough to file it.
+  NetTotal *float64 `json:"netTotal,omitempty"`
+  VatTotal *float64 `json:"vatTotal,omitempty"`
+  GrossTotal *float64 `json:"grossTotal,omitempty"`
+  // Tax identification numbers found in the text, digits only.
+  Nips []string `json:"nips,omitempty"`
+  Text string `json:"text,omitempty"`
+  ReceivedAt time.Time `json:"receivedAt"`
+  FiledAt time.Time `json:"filedAt"`
+}
+
+func Path() string {
+  return filepath.Join(env.Get("ICLOUD_PATH"), "Documents", "Firma", FILE)
+}
+
+// Load returns all the records, oldest invoice first.
+func Load() ([]Record, error) {
+  data, err := os.ReadFile(Path())
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("error reading index: %v", err)
+  }
+
+  records := []Record{}
+  if err := json.Unmarshal(data, &records); err != nil {
+    return nil, fmt.Errorf("error unmarshalling index: %v", err)
+  }
+
+  return records, nil
+}
+
+// Add records a filed document, replacing the record of the same path.
+func Add(record Record) error {
+  records, err := Load()
+  if err != nil {
+    return err
+  }
+
+  record.FiledAt = time.Now()
+  if record.Nips == nil {
+    record.Nips = Nips(record.Text)
+  }
+
+  records = slices.DeleteFunc(records, func(r Record) bool {
+    return r.Path == record.Path
+  })
+  records = append(records, record)
+  sort.SliceStable(records, func(i, j int) bool {
+    return records[i].InvoiceDate < records[j].InvoiceDate
+  })
+
+  data, err := json.MarshalIndent(records, "", "  ")
+  if err != nil {
+    return fmt.Errorf("error marshalling index: %v", err)
+  }
+
+  // Written next to it and renamed, a crash doesn't leave half of the index.
+  tmp := Path() + ".tmp"
+  if err := os.WriteFile(tmp, data, 0644); err != nil {
+    return fmt.Errorf("error saving index: %v", err)
+  }
+  if err := os.Rename(tmp, Path()); err != nil {
+    return fmt.Errorf("error saving index: %v", err)
+  }
+
+  l.Print("Indexed ", filepath.Base(record.Path), ".")
+  return nil
+}
+
+// Query filters the records, the empty fields match everything.
+type Query struct {
+  // Case-insensitive, in the text or the path.
+  Text string
+  // Dates of the invoice, YYYY-MM-DD, both inclusive.
+  From string
+  To string
+  Label llm.DocumentLabel
+  MissingNip bool
+}
+
+func Search(records []Record, query Query) []Record {
+  text := strings.ToLower(query.Text)
+
+  found := []Record{}
+  for _, record := range records {
+    if query.From != "" && record.InvoiceDate < query.From {
+      continue
+    }
+    if query.To != "" && record.InvoiceDate > query.To {
+      continue
+    }
+    if query.Label != "" && record.Label != query.Label {
+      continue
+    }
+    if query.MissingNip && len(record.Nips) > 0 {
+      continue
+    }
+    if text != "" && !strings.Contains(strings.ToLower(record.Text), text) && !strings.Contains(strings.ToLower(record.Path), text) {
+      continue
+    }
+    found = append(found, record)
+  }
+
+  return found
+}
+
+// Snippet is the part of the text around the first match of the query, or
+// the beginning of the text.
+func (r Record) Snippet(query string) string {
+  text := strings.Join(strings.Fields(r.Text), " ")
+
+  start := 0
+  if query != "" {
+    if i := strings.Index(strings.ToLower(text), strings.ToLower(query)); i > 0 {
+      start = max(0, i - SNIPPET_LENGTH / 4)
+    }
+  }
+  // A byte offset, don't start in the middle of a Polish letter.
+  for start < len(text) && !utf8.RuneStart(text[start]) {
+    start++
+  }
+
+  runes := []rune(text[start:])
+  if len(runes) > SNIPPET_LENGTH {
+    runes = runes[:SNIPPET_LENGTH]
+  }
+  return string(runes)
+}
+
+// The NIP follows its label, possibly after "PL", written as 1234567890,
+// 123-456-78-90 or 123-45-67-890, with dashes or spaces.
+var nipPattern = regexp.MustCompile(`(?i)\bNIP\b[^0-9]{0,12}(\d{3}[- ]?\d{2,3}[- ]?\d{2}[- ]?\d{2,3})`)
+
+// Nips returns the tax identification numbers labelled as such in the text.
+func Nips(text string) []string {
+  nips := []string{}
+  seen := map[string]bool{}
+  for _, match := range nipPattern.FindAllStringSubmatch(text, -1) {
+    digits := strings.Map(func(r rune) rune {
+      if r >= '0' && r <= '9' {
+        return r
+      }
+      return -1
+    }, match[1])
+
+    if len(digits) != 10 || seen[digits] {
+      continue
+    }
+    seen[digits] = true
+    nips = append(nips, digits)
+  }
+  return nips
+}
@@ -0,0 +1,93 @@
+package index_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/krol22/invoice_go_sort_sort/index"
+)
+
+func TestNips(t *testing.T) {
+  cases := []struct {
+    name string
+    text string
+    want []string
+  }{
+    {"plain", "NIP: 5252344078", []string{"5252344078"}},
+    {"with country", "NIP PL 525-234-40-78", []string{"5252344078"}},
+    {"dashes the other way", "nip 525-23-44-078", []string{"5252344078"}},
+    {"spaces", "NIP: 525 234 40 78", []string{"5252344078"}},
+    {"seller and buyer", "Sprzedawca NIP 5252344078\nNabywca NIP: 1132853869\nNIP 5252344078", []string{"5252344078", "1132853869"}},
+    {"too short", "NIP: 525234407", []string{}},
+    {"too long", "NIP: 52523440781", []string{}},
+    {"not labelled", "REGON 5252344078, KRS 0000581417", []string{}},
+    {"part of a word", "SNIP 5252344078", []string{}},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      if got := index.Nips(c.text); !reflect.DeepEqual(got, c.want) {
+        t.Errorf("Nips(%q) = %v, want %v", c.text, got, c.want)
+      }
+    })
+  }
+}
+
+func TestSearchDates(t *testing.T) {
+  records := []index.Record{
+    {Path: "luty.pdf", InvoiceDate: "2024-02-29"},
+    {Path: "marzec.pdf", InvoiceDate: "2024-03-01"},
+    {Path: "marzec_koniec.pdf", InvoiceDate: "2024-03-31"},
+    {Path: "kwiecien.pdf", InvoiceDate: "2024-04-01"},
+  }
+  cases := []struct {
+    name string
+    query index.Query
+    want []string
+  }{
+    {"everything", index.Query{}, []string{"luty.pdf", "marzec.pdf", "marzec_koniec.pdf", "kwiecien.pdf"}},
+    {"both inclusive", index.Query{From: "2024-03-01", To: "2024-03-31"}, []string{"marzec.pdf", "marzec_koniec.pdf"}},
+    {"from only", index.Query{From: "2024-03-31"}, []string{"marzec_koniec.pdf", "kwiecien.pdf"}},
+    {"to only", index.Query{To: "2024-03-01"}, []string{"luty.pdf", "marzec.pdf"}},
+    {"single day", index.Query{From: "2024-02-29", To: "2024-02-29"}, []string{"luty.pdf"}},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      got := []string{}
+      for _, record := range index.Search(records, c.query) {
+        got = append(got, record.Path)
+      }
+      if !reflect.DeepEqual(got, c.want) {
+        t.Errorf("Search(%+v) = %v, want %v", c.query, got, c.want)
+      }
+    })
+  }
+}
+
+func TestSnippet(t *testing.T) {
+  // 60 bytes of two-byte letters, the start before the match is in the
+  // middle of one.
+  polish := strings.Repeat("ż", 30)
+  cases := []struct {
+    name string
+    text string
+    query string
+    want string
+  }{
+    {"beginning", "FAKTURA VAT\n\n nr 1/03/2024", "", "FAKTURA VAT nr 1/03/2024"},
+    {"no match", "FAKTURA VAT nr 1/03/2024", "OVH", "FAKTURA VAT nr 1/03/2024"},
+    {"around the match", strings.Repeat("x", 100) + " OVH Sp. z o.o.", "ovh", strings.Repeat("x", 49) + " OVH Sp. z o.o."},
+    {"start in a letter", polish + " OVH Sp. z o.o.", "ovh", strings.Repeat("ż", 24) + " OVH Sp. z o.o."},
+    {"cut to the length", strings.Repeat("ż", index.SNIPPET_LENGTH + 10), "", strings.Repeat("ż", index.SNIPPET_LENGTH)},
+  }
+
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      if got := (index.Record{Text: c.text}).Snippet(c.query); got != c.want {
+        t.Errorf("Snippet(%q) = %q, want %q", c.query, got, c.want)
+      }
+    })
+  }
+}
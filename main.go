@@ -1,27 +1,53 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/krol22/invoice_go_sort_sort/ai"
 	"github.com/krol22/invoice_go_sort_sort/ai/llm"
+	"github.com/krol22/invoice_go_sort_sort/dates"
 	"github.com/krol22/invoice_go_sort_sort/email"
 	"github.com/krol22/invoice_go_sort_sort/env"
+	"github.com/krol22/invoice_go_sort_sort/index"
 	"github.com/krol22/invoice_go_sort_sort/log"
+	"github.com/krol22/invoice_go_sort_sort/notifications"
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+	"github.com/krol22/invoice_go_sort_sort/review"
 	"github.com/krol22/invoice_go_sort_sort/state"
-	"github.com/pdfcpu/pdfcpu/pkg/api"
-	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/krol22/invoice_go_sort_sort/utils"
+	"github.com/krol22/invoice_go_sort_sort/workspace"
 )
 
 var l = log.Get()
 
+// Below this many characters the text layer is most likely missing (scanned
+// invoice) and the model gets the PDF itself instead.
+const MIN_TEXT_LENGTH = 100
+
+// The scans and photos of the invoices, by the extension, with the media
+// type the model takes them in.
+var IMAGE_TYPES = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+}
+
+// Smaller images are the logos and the icons of the email signatures, not
+// scans. The model takes 5 MB at most.
+const (
+	MIN_IMAGE_SIZE = 50 * 1024
+	MAX_IMAGE_SIZE = 5 * 1024 * 1024
+)
+
 var polishMonths = map[time.Month]string{
 	time.January:   "styczeń",
 	time.February:  "luty",
@@ -37,12 +63,12 @@ var polishMonths = map[time.Month]string{
 	time.December:  "grudzień",
 }
 
-func getInvoiceMonthPath(invoiceDate string) string {
+func getInvoiceMonthPath(invoiceDate string) (string, error) {
 	icloudPath := env.Get("ICLOUD_PATH")
 
 	date, err := time.Parse("2006-01-02", invoiceDate)
 	if err != nil {
-		l.Fatal().Err(err).Msg("Error parsing date")
+		return "", fmt.Errorf("error parsing date: %v", err)
 	}
 
 	year := date.Year()
@@ -50,101 +76,96 @@ func getInvoiceMonthPath(invoiceDate string) string {
 
 	monthName := polishMonths[month]
 
-	return icloudPath + "/Documents/Firma/" + fmt.Sprint(year) + "/dokumenty_" + monthName
+	return icloudPath + "/Documents/Firma/" + fmt.Sprint(year) + "/dokumenty_" + monthName, nil
 }
 
-func createFoldersIfNecessary(path string) {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		os.MkdirAll(path, 0755)
+// getDocumentPath picks the folder by the kind of the document, corrections
+// and proformas don't go together with the regular invoices.
+func getDocumentPath(label llm.DocumentLabel, invoiceDate string) (string, error) {
+	monthPath, err := getInvoiceMonthPath(invoiceDate)
+	if err != nil {
+		return "", err
 	}
-}
-
-
-func upgradePDFVersion() ([]byte, error) {
-		tmpDir := os.TempDir()
-		pdfPath := tmpDir + "/pdf.pdf"
-		inputFile, err := os.Open(pdfPath)
-    if err != nil {
-        return nil, fmt.Errorf("error opening input file: %v", err)
-    }
-    defer inputFile.Close()
-
-    // Create configuration with version 1.4
-    conf := model.NewDefaultConfiguration()
-    conf.Version = "1.4"
-
-    // Get page count of input file
-    pageCount, err := api.PageCount(inputFile, conf)
-    if err != nil {
-        return nil, fmt.Errorf("error getting page count: %v", err)
-    }
 
-    // Create a list of pages to copy (all pages)
-    pages := make([]string, pageCount)
-    for i := 0; i < pageCount; i++ {
-        pages[i] = fmt.Sprintf("%d", i+1)
-    }
-
-		tempDir, err := os.MkdirTemp("", "pdf_upgrade_*")
-    if err != nil {
-        return nil, fmt.Errorf("error creating temp directory: %v", err)
-    }
-    // defer os.RemoveAll(tempDir) // Clean up when done
-
-		outputFilename := "upgraded.pdf"
+	switch label {
+	case llm.LABEL_CORRECTION_INVOICE:
+		return monthPath + "/korekty", nil
+	case llm.LABEL_PROFORMA:
+		return filepath.Dir(monthPath) + "/proformy", nil
+	default:
+		return monthPath, nil
+	}
+}
 
-    // Extract pages to temp directory
-    err = api.ExtractPages(inputFile, tempDir, outputFilename, pages, conf)
-    if err != nil {
-        return nil, fmt.Errorf("error extracting pages: %v", err)
-    }
+// fileInvoice saves the document in the archive and returns its path.
+func fileInvoice(label llm.DocumentLabel, invoiceDate string, filename string, content []byte) (string, error) {
+	invoicePath, err := getDocumentPath(label, invoiceDate)
+	if err != nil {
+		return "", err
+	}
+	l.Print("Selecting path for the invoice (", filename, "): ", invoicePath)
+	createFoldersIfNecessary(invoicePath)
 
-		// Get list of extracted files
-    var inFiles []string
-    for i := 1; i <= pageCount; i++ {
-        inFiles = append(inFiles, filepath.Join(tempDir, fmt.Sprintf("upgraded_page_%d.pdf", i)))
-    }
+	l.Print("Saving invoice to: ", invoicePath+"/"+filename)
+	err = os.WriteFile(invoicePath+"/"+filename, content, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to save invoice: %v", err)
+	}
 
-    // Create buffer for final output
-    var buf bytes.Buffer
+	return invoicePath + "/" + filename, nil
+}
 
-    // Merge all pages into a single PDF
-    err = api.Merge("", inFiles, &buf, conf, false)
-    if err != nil {
-        return nil, fmt.Errorf("error merging pages: %v", err)
-    }
+// indexInvoice records the filed document for the ask command. The document
+// is already filed, so a failure is only logged.
+func indexInvoice(path string, label llm.DocumentLabel, invoiceDate string, text string, output map[string]interface{}, receivedAt time.Time) {
+	err := index.Add(index.Record{
+		Path:        path,
+		Label:       label,
+		InvoiceDate: invoiceDate,
+		NetTotal:    optionalNumber(output, "netTotal"),
+		VatTotal:    optionalNumber(output, "vatTotal"),
+		GrossTotal:  optionalNumber(output, "grossTotal"),
+		Text:        text,
+		ReceivedAt:  receivedAt,
+	})
+	if err != nil {
+		l.Error().Err(err).Str("path", path).Msg("Failed to index the invoice")
+	}
+}
 
-    fmt.Printf("Successfully created new PDF version 1.4 with %d pages\n", pageCount)
-    return buf.Bytes(), nil
+func optionalNumber(output map[string]interface{}, field string) *float64 {
+	value, ok := output[field].(float64)
+	if !ok {
+		return nil
+	}
+	return &value
 }
 
-func extractTextFromPDF(file []byte) (string, error) {
-	tmpDir := os.TempDir()
-	pdfPath := tmpDir + "/pdf.pdf"
-	err := os.WriteFile(pdfPath, file, 0644)
+func createFoldersIfNecessary(path string) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		os.MkdirAll(path, 0755)
+	}
+}
 
+// extractTextFromPDF reads the text of the PDF, with the scanned pages read
+// by OCR when it's available. The OCR renders the pages into the directory.
+func extractTextFromPDF(pdfPath string, dir string) (*pdf.Document, error) {
+	extractor, err := pdf.LoadExtractor()
 	if err != nil {
-		return "", fmt.Errorf("error writing pdf file: %v", err)
+		return nil, err
 	}
-
-	l.Print("Executing pdf2txt.py")
-	homeDir, err := os.UserHomeDir()
+	ocr, err := pdf.LoadOCR()
 	if err != nil {
-		return "", fmt.Errorf("error getting home directory: %v", err)
+		return nil, err
 	}
-	cmd := exec.Command(filepath.Join(homeDir, "/Library/Python/3.9/bin/pdf2txt.py"), pdfPath)
-	
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	
-	err = cmd.Run()
+
+	document, err := pdf.Read(pdfPath, extractor, ocr, dir)
 	if err != nil {
-		return "", fmt.Errorf("error executing pdf2txt.py: %v\nStderr: %s", err, stderr.String())
+		return nil, err
 	}
 
-	l.Print("Extracted content from the PDF: ", len(stdout.String()), " characters.")
-	return stdout.String(), nil
+	l.Print("Extracted content from the PDF: ", len(document.Text()), " characters.")
+	return document, nil
 }
 
 func getEmailInvoices(lastRun time.Time) ([]*email.EmailMessage, error) {
@@ -165,39 +186,694 @@ func getEmailInvoices(lastRun time.Time) ([]*email.EmailMessage, error) {
 	return messages, nil
 }
 
-func analyzeAttachment(pdfText string, attachment *email.Attachment) error {
-	anthropicClient := ai.NewClient(env.Get("ANTHROPIC_KEY"))
-	analyzeInvoice := llm.NewAnalyzeInvoiceLLM(&llm.AnalyzeInvoiceLLMInput{
-		Invoice: pdfText,
+// invoiceDocument is a PDF attachment on its way through the pipeline.
+type invoiceDocument struct {
+	emailMessage *email.EmailMessage
+	attachment   *email.Attachment
+	text         string
+	label        llm.DocumentLabel
+	// Fragments of the text that look like instructions for the model.
+	suspicious []string
+	// The models each routed task went through.
+	routes map[string][]ai.RouteStep
+	// How the text goes to the model, and the texts to send: the whole text,
+	// its first and last pages, or the parts analysed one by one.
+	strategy *llm.DocumentStrategy
+	parts    []string
+	// The scanned pages, read by OCR.
+	ocrPages []int
+	// What the normalization did, and the copy to archive instead of the
+	// attachment, if any.
+	normalization *pdf.NormalizeReport
+	archive       []byte
+	// The decrypted copy of an encrypted PDF, for the model. An encrypted PDF
+	// without it is locked, see reviewLocked.
+	encrypted bool
+	decrypted []byte
+	// Filed, or waiting in the review. A document that isn't was skipped.
+	sorted bool
+}
+
+func newInvoiceDocument(emailMessage *email.EmailMessage, attachment *email.Attachment, document *pdf.Document) (*invoiceDocument, error) {
+	text := document.Text()
+	doc := &invoiceDocument{
+		emailMessage:  emailMessage,
+		attachment:    attachment,
+		text:          text,
+		ocrPages:      document.OCRPages,
+		normalization: document.Normalization,
+		archive:       document.Archive,
+		encrypted:     document.Encrypted,
+		decrypted:     document.Decrypted,
+	}
+
+	settings, err := llm.LoadLongDocumentSettings()
+	if err != nil {
+		return nil, err
+	}
+	doc.strategy, doc.parts = llm.PlanDocument(document.TextPages(), settings)
+	if doc.strategy.Name != llm.STRATEGY_FULL {
+		l.Print(attachment.Filename, " is too long to send whole, ", doc.strategy, ".")
+	}
+
+	// The email goes into the prompt too.
+	emailContext := doc.emailContext()
+	doc.suspicious = llm.SuspiciousContent(strings.Join([]string{text, emailContext.Subject, emailContext.Body}, "\n"))
+	if len(doc.suspicious) > 0 {
+		l.Warn().Strs("fragments", doc.suspicious).Msg(attachment.Filename + " looks like a prompt injection, it will go to review")
+	}
+
+	return doc, nil
+}
+
+func (d *invoiceDocument) recordRoute(task string, response *ai.AiResponse) {
+	if response == nil || len(response.Route) == 0 {
+		return
+	}
+
+	if d.routes == nil {
+		d.routes = map[string][]ai.RouteStep{}
+	}
+	d.routes[task] = response.Route
+}
+
+// review sends the document to the review folder, with the entry completed
+// with what we know about the document.
+func (d *invoiceDocument) review(entry review.Entry) error {
+	entry.Filename = d.attachment.Filename
+	entry.Label = d.label
+	entry.Routes = d.routes
+	entry.Text = d.text
+	entry.LongDocument = d.longDocument()
+	entry.OCRPages = d.ocrPages
+	entry.Normalization = d.normalization
+	emailContext := d.emailContext()
+	entry.Email = &review.Email{Subject: emailContext.Subject, From: emailContext.From, Body: emailContext.Body}
+	entry.ReceivedAt = d.receivedAt()
+
+	if _, err := review.Add(d.archived(), &entry); err != nil {
+		return err
+	}
+	d.sorted = true
+	return nil
+}
+
+// emailContext is what the email says about the document, for the analysis.
+func (d *invoiceDocument) emailContext() *llm.EmailContext {
+	return &llm.EmailContext{
+		Subject: d.emailMessage.Message.Envelope.Subject,
+		From:    d.emailMessage.Sender(),
+		Body:    email.TrimBody(d.emailMessage.Body, email.MAX_BODY_LENGTH),
+	}
+}
+
+func (d *invoiceDocument) receivedAt() time.Time {
+	return d.emailMessage.Message.Envelope.Date
+}
+
+// hasText tells if the text layer is usable, otherwise the model gets the PDF.
+func (d *invoiceDocument) hasText() bool {
+	return len(strings.TrimSpace(d.text)) >= MIN_TEXT_LENGTH
+}
+
+// images is the attachment for the model when it's an image, not a PDF.
+func (d *invoiceDocument) images() []llm.InvoiceImage {
+	mediaType := imageMediaType(d.attachment.Filename)
+	if mediaType == "" {
+		return nil
+	}
+	return []llm.InvoiceImage{{MediaType: mediaType, Content: d.attachment.Content}}
+}
+
+// readable is the PDF for the model, it can't open the encrypted ones.
+func (d *invoiceDocument) readable() []byte {
+	if d.decrypted != nil {
+		return d.decrypted
+	}
+	return d.attachment.Content
+}
+
+// locked tells if the PDF is encrypted with a password we don't have.
+func (d *invoiceDocument) locked() bool {
+	return d.encrypted && d.decrypted == nil
+}
+
+// reviewLocked sends the locked PDF to review, saying whose password is
+// missing.
+func reviewLocked(doc *invoiceDocument) error {
+	sender := doc.emailMessage.SenderAddress()
+	l.Warn().Str("filename", doc.attachment.Filename).Str("sender", sender).Msg("No password for the encrypted PDF, it goes to review")
+
+	details := []string{"the PDF is encrypted and none of the stored passwords opens it"}
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		details = append(details, fmt.Sprintf("add the password with: password set %s <password>, or password set %s <password> for the whole domain", sender, sender[at+1:]))
+	}
+	details = append(details, "then analyse it again with: review retry <file>")
+	return doc.review(review.Entry{Reason: "missing password", Details: details})
+}
+
+// archived is the PDF to file, the attachment itself unless it was cleaned
+// up, see PDF_ARCHIVE_CLEANUP.
+func (d *invoiceDocument) archived() []byte {
+	if d.archive != nil {
+		return d.archive
+	}
+	return d.attachment.Content
+}
+
+// ocr tells if the text sent to the model was read by OCR, and can have
+// misread characters.
+func (d *invoiceDocument) ocr() bool {
+	return len(d.ocrPages) > 0 && d.hasText()
+}
+
+// firstPart is the text sent when there is a single request, the beginning
+// of a chunked document is enough to classify it.
+func (d *invoiceDocument) firstPart() string {
+	if len(d.parts) == 0 {
+		return d.text
+	}
+	return d.parts[0]
+}
+
+// chunked tells if the analysis goes part by part, see analyzeParts.
+func (d *invoiceDocument) chunked() bool {
+	return len(d.parts) > 1 && d.hasText()
+}
+
+// longDocument is the strategy for the records, when it wasn't sent whole.
+func (d *invoiceDocument) longDocument() *llm.DocumentStrategy {
+	if d.strategy == nil || d.strategy.Name == llm.STRATEGY_FULL || !d.hasText() {
+		return nil
+	}
+	return d.strategy
+}
+
+func newClassifyDocument(doc *invoiceDocument) *llm.ClassifyDocumentLLM {
+	input := &llm.ClassifyDocumentLLMInput{
+		Filename: doc.attachment.Filename,
+		Document: doc.firstPart(),
+	}
+	if images := doc.images(); !doc.hasText() && images != nil {
+		input.Images = images
+	} else if !doc.hasText() {
+		input.Pdf = doc.readable()
+	}
+
+	return llm.NewClassifyDocumentLLM(input)
+}
+
+func newAnalyzeInvoice(doc *invoiceDocument) *llm.AnalyzeInvoiceLLM {
+	return llm.NewAnalyzeInvoiceLLM(doc.analyzeInput(doc.firstPart()))
+}
+
+func (d *invoiceDocument) analyzeInput(text string) *llm.AnalyzeInvoiceLLMInput {
+	input := &llm.AnalyzeInvoiceLLMInput{
+		Invoice:    text,
+		ReceivedAt: d.receivedAt(),
+		Email:      d.emailContext(),
+		OCR:        d.ocr(),
+	}
+	if images := d.images(); !d.hasText() && images != nil {
+		l.Print("Extracted text is too short, sending the image itself.")
+		input.Images = images
+	} else if !d.hasText() {
+		l.Print("Extracted text is too short, sending the PDF itself.")
+		input.Document = d.readable()
+	}
+
+	return input
+}
+
+// analyzeDocument runs the invoice analysis, part by part for the chunked
+// documents.
+func analyzeDocument(ctx context.Context, anthropicClient *ai.AnthropicClient, doc *invoiceDocument) (*llm.AnalyzeInvoiceLLM, error) {
+	if doc.chunked() {
+		return analyzeParts(ctx, anthropicClient, doc)
+	}
+
+	analyzeInvoice := newAnalyzeInvoice(doc)
+	_, err := anthropicClient.RunLLM(ctx, analyzeInvoice)
+	return analyzeInvoice, err
+}
+
+// analyzeParts analyzes the parts one by one and merges the answers. A part
+// with an invalid answer is left out, the merged answer is checked anyway.
+func analyzeParts(ctx context.Context, anthropicClient *ai.AnthropicClient, doc *invoiceDocument) (*llm.AnalyzeInvoiceLLM, error) {
+	parts := []*llm.AnalyzeInvoiceLLM{}
+	for i, text := range doc.parts {
+		input := doc.analyzeInput(text)
+		input.Part = i + 1
+		input.Parts = len(doc.parts)
+
+		part := llm.NewAnalyzeInvoiceLLM(input)
+		_, err := anthropicClient.RunLLM(ctx, part)
+		doc.recordRoute(fmt.Sprintf("%s part %d", llm.ANALYZE_INVOICE, i+1), part.GetAiResponse())
+
+		var validationErr *ai.ValidationError
+		if errors.As(err, &validationErr) {
+			l.Print("Skipping part ", i+1, " of ", doc.attachment.Filename, ": ", err)
+			continue
+		}
+		if err != nil {
+			return llm.NewAnalyzeInvoiceLLM(doc.analyzeInput(doc.text)), err
+		}
+		parts = append(parts, part)
+	}
+
+	return llm.MergeAnalyses(doc.analyzeInput(doc.text), parts)
+}
+
+// handleClassification takes the result of the classification, and tells if
+// the document goes on to the analysis.
+func handleClassification(doc *invoiceDocument, classifyDocument *llm.ClassifyDocumentLLM, err error) (bool, error) {
+	doc.recordRoute(llm.CLASSIFY_DOCUMENT, classifyDocument.GetAiResponse())
+
+	var validationErr *ai.ValidationError
+	if errors.As(err, &validationErr) {
+		return false, doc.review(review.Entry{
+			Reason:        "unknown document type",
+			Details:       strings.Split(validationErr.Err.Error(), "\n"),
+			Output:        validationErr.Output,
+			PromptVersion: llm.CLASSIFY_DOCUMENT + "@" + validationErr.PromptVersion,
+		})
+	}
+
+	var disagreement *ai.DisagreementError
+	if errors.As(err, &disagreement) {
+		return false, doc.review(review.Entry{
+			Reason:        "unknown document type",
+			Details:       []string{disagreement.Error()},
+			Output:        classifyDocument.GetAiResponse().JsonOutput,
+			PromptVersion: llm.CLASSIFY_DOCUMENT + "@" + classifyDocument.GetPromptVersion(),
+		})
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to classify document: %w", err)
+	}
+
+	doc.label = classifyDocument.GetOutput().Label
+	if doc.label == llm.LABEL_OTHER && len(doc.suspicious) > 0 {
+		// The text could have asked for this label to get skipped.
+		return false, fileDocument(doc, "", review.Entry{
+			Output:        classifyDocument.GetAiResponse().JsonOutput,
+			PromptVersion: llm.CLASSIFY_DOCUMENT + "@" + classifyDocument.GetPromptVersion(),
+		})
+	}
+	if doc.label == llm.LABEL_OTHER {
+		l.Print("Skipping ", doc.attachment.Filename, ", it's not a document we file.")
+		return false, nil
+	}
+	l.Print("Document ", doc.attachment.Filename, " is a ", doc.label, ".")
+
+	return true, nil
+}
+
+// fileByTextDate files the document if it has a clearly labelled issue date,
+// most invoices do and there is no need to pay for the model to read it.
+func fileByTextDate(doc *invoiceDocument) (bool, error) {
+	// A misread digit would file it under a wrong date, with no one looking.
+	if doc.ocr() {
+		l.Print("The text was read by OCR, asking the AI.")
+		return false, nil
+	}
+
+	found := dates.Find(doc.text)
+	if !found.Found {
+		l.Print("Couldn't find the invoice date in the text (", found.Reason, "), asking the AI.")
+		return false, nil
+	}
+
+	// A sale date is the issue date on most invoices, not all of them.
+	threshold, err := review.ConfidenceThreshold()
+	if err != nil {
+		return false, err
+	}
+	if found.Score < threshold {
+		l.Print("Found only a ", found.Reason, " in the text, scored ", found.Score, ", asking the AI.")
+		return false, nil
+	}
+
+	invoiceDate := found.Date.Format("2006-01-02")
+	if err := llm.ValidateInvoiceDate(invoiceDate, doc.receivedAt()); err != nil {
+		l.Print("Date found in the text is implausible, asking the AI: ", err)
+		return false, nil
+	}
+
+	l.Print("Found the invoice date in the text (", found.Reason, "), skipping the AI.")
+	return true, fileDocument(doc, invoiceDate, review.Entry{
+		Output: map[string]interface{}{"date": invoiceDate},
 	})
+}
+
+// handleAnalysis files the analyzed invoice, or sends it to review when the
+// output can't be trusted.
+func handleAnalysis(doc *invoiceDocument, analyzeInvoice *llm.AnalyzeInvoiceLLM, err error) error {
+	doc.recordRoute(llm.ANALYZE_INVOICE, analyzeInvoice.GetAiResponse())
+
+	var validationErr *ai.ValidationError
+	if errors.As(err, &validationErr) {
+		return doc.review(review.Entry{
+			Reason:        "invalid output",
+			Details:       strings.Split(validationErr.Err.Error(), "\n"),
+			Output:        validationErr.Output,
+			PromptVersion: llm.ANALYZE_INVOICE + "@" + validationErr.PromptVersion,
+		})
+	}
 
-	_, err := anthropicClient.RunLLM(analyzeInvoice)
+	var disagreement *ai.DisagreementError
+	if errors.As(err, &disagreement) {
+		return doc.review(review.Entry{
+			Reason:        "models disagree",
+			Details:       []string{disagreement.Error()},
+			Output:        analyzeInvoice.GetAiResponse().JsonOutput,
+			Confidence:    analyzeInvoice.Confidence(),
+			PromptVersion: llm.ANALYZE_INVOICE + "@" + analyzeInvoice.GetPromptVersion(),
+		})
+	}
 
 	if err != nil {
-		l.Fatal().Err(err).Msg("Failed to analyze invoice")
+		return fmt.Errorf("failed to analyze invoice: %w", err)
 	}
 
 	outputData := analyzeInvoice.GetOutput()
 
-	invoicePath := getInvoiceMonthPath(outputData.InvoiceDate)
-	l.Print("Selecting path for the invoice (", attachment.Filename, "): ", invoicePath)
-	createFoldersIfNecessary(invoicePath)
+	threshold, err := review.ConfidenceThreshold()
+	if err != nil {
+		return err
+	}
+
+	// Only the date decides where the invoice goes, the totals are informative.
+	confidence := analyzeInvoice.Confidence()
+	if confidence["date"].Score < threshold {
+		return doc.review(review.Entry{
+			Reason:        "low confidence",
+			Details:       []string{fmt.Sprintf("date confidence %.2f is below %.2f", confidence["date"].Score, threshold)},
+			Output:        analyzeInvoice.GetAiResponse().JsonOutput,
+			Confidence:    confidence,
+			PromptVersion: llm.ANALYZE_INVOICE + "@" + analyzeInvoice.GetPromptVersion(),
+		})
+	}
 
-	l.Print("Saving invoice to: ", invoicePath+"/"+attachment.Filename)
-	err = os.WriteFile(invoicePath+"/"+attachment.Filename, attachment.Content, 0644)
+	l.Print("Invoice date ", outputData.InvoiceDate, " from prompt ", llm.ANALYZE_INVOICE, "@", analyzeInvoice.GetPromptVersion(), ".")
+	return fileDocument(doc, outputData.InvoiceDate, review.Entry{
+		Output:        analyzeInvoice.GetAiResponse().JsonOutput,
+		Confidence:    confidence,
+		PromptVersion: llm.ANALYZE_INVOICE + "@" + analyzeInvoice.GetPromptVersion(),
+	})
+}
+
+// fileDocument files the document, unless its text tries to instruct the
+// model. Then nothing the model said can be trusted, and it goes to review.
+func fileDocument(doc *invoiceDocument, invoiceDate string, entry review.Entry) error {
+	if len(doc.suspicious) > 0 {
+		entry.Reason = "suspicious content"
+		entry.Details = doc.suspicious
+		return doc.review(entry)
+	}
+
+	if len(doc.routes) > 0 {
+		l.Print("Decision path of ", doc.attachment.Filename, ": ", utils.PrettyPrint(doc.routes))
+	}
+	if strategy := doc.longDocument(); strategy != nil {
+		l.Print("Analyzed ", doc.attachment.Filename, " with ", strategy, ".")
+	}
+	if doc.ocr() {
+		l.Print("Pages ", doc.ocrPages, " of ", doc.attachment.Filename, " were read by OCR.")
+	}
+	path, err := fileInvoice(doc.label, invoiceDate, doc.attachment.Filename, doc.archived())
 	if err != nil {
-		l.Fatal().Err(err).Msg("Failed to save invoice")
+		return err
 	}
 
+	indexInvoice(path, doc.label, invoiceDate, doc.text, entry.Output, doc.receivedAt())
+	doc.sorted = true
 	return nil
 }
 
-func main() {
-	for range 10 {
-		l.Print("#################################")
+func analyzeAttachment(ctx context.Context, anthropicClient *ai.AnthropicClient, document *pdf.Document, emailMessage *email.EmailMessage, attachment *email.Attachment) error {
+	doc, err := newInvoiceDocument(emailMessage, attachment, document)
+	if err != nil {
+		return err
 	}
+	return sortDocument(ctx, anthropicClient, doc)
+}
 
-	l.Print("Starting invoice sorting...")
+// sortDocument files the document or sends it to review, unless it's not a
+// document we keep, see invoiceDocument.sorted.
+func sortDocument(ctx context.Context, anthropicClient *ai.AnthropicClient, doc *invoiceDocument) error {
+	if doc.locked() {
+		return reviewLocked(doc)
+	}
+
+	// Classified first even when the text has a labelled date, the label picks
+	// the folder and skips the documents we don't file. It costs one request.
+	classifyDocument := newClassifyDocument(doc)
+	_, err := anthropicClient.RunLLM(ctx, classifyDocument)
+	if next, err := handleClassification(doc, classifyDocument, err); !next || err != nil {
+		return err
+	}
+
+	if filed, err := fileByTextDate(doc); filed || err != nil {
+		return err
+	}
+
+	analyzeInvoice, err := analyzeDocument(ctx, anthropicClient, doc)
+	return handleAnalysis(doc, analyzeInvoice, err)
+}
+
+func imageMediaType(filename string) string {
+	return IMAGE_TYPES[strings.ToLower(filepath.Ext(filename))]
+}
+
+// attachmentDocument reads the PDFs, see attachmentText, and the images, see
+// imageText. Nil for the attachments that aren't invoices.
+func attachmentDocument(attachment *email.Attachment, sender string, passwords *pdf.Passwords) (*pdf.Document, error) {
+	if strings.HasSuffix(strings.ToLower(attachment.Filename), ".pdf") {
+		return attachmentText(attachment, sender, passwords)
+	}
+	if imageMediaType(attachment.Filename) == "" || len(attachment.Content) < MIN_IMAGE_SIZE {
+		return nil, nil
+	}
+	if len(attachment.Content) > MAX_IMAGE_SIZE {
+		l.Warn().Str("filename", attachment.Filename).Int("size", len(attachment.Content)).Msg("The image is too big for the model, skipping it")
+		return nil, nil
+	}
+	return imageText(attachment)
+}
+
+// imageText reads the scan with the OCR, when it's installed. Without it, or
+// with too little text, the model gets the image itself.
+func imageText(attachment *email.Attachment) (*pdf.Document, error) {
+	ocr, err := pdf.LoadOCR()
+	if err != nil {
+		return nil, err
+	}
+	if ocr == nil {
+		return &pdf.Document{}, nil
+	}
+
+	ws, err := workspace.New()
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Close()
+
+	imagePath, err := ws.WriteFile("original"+strings.ToLower(filepath.Ext(attachment.Filename)), attachment.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Print("Reading ", attachment.Filename, " with OCR.")
+	text, err := ocr.Image(imagePath)
+	if err != nil {
+		l.Warn().Err(err).Str("filename", attachment.Filename).Msg("OCR failed, sending the image only")
+		return &pdf.Document{}, nil
+	}
+	if strings.TrimSpace(text) == "" {
+		return &pdf.Document{}, nil
+	}
+	return &pdf.Document{Pages: []string{text}, OCRPages: []int{1}}, nil
+}
+
+// attachmentText decrypts the PDF with the passwords of the sender when it's
+// encrypted, normalizes it and extracts its text, from the original when the
+// normalization fails or the normalized copy can't be read. Empty text means
+// the model gets the PDF only. The document is locked only when there's no
+// password for it, a broken encrypted PDF has the error in its report. The
+// files are in a workspace of the attachment, removed before it returns.
+func attachmentText(attachment *email.Attachment, sender string, passwords *pdf.Passwords) (*pdf.Document, error) {
+	options, err := pdf.LoadNormalizeOptions()
+	if err != nil {
+		return nil, err
+	}
+	archiveDecrypted, err := pdf.ArchiveDecrypted()
+	if err != nil {
+		return nil, err
+	}
+	ws, err := workspace.New()
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Close()
+
+	pdfPath, err := ws.WriteFile("original.pdf", attachment.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	decryptedPath := ws.Path("decrypted.pdf")
+	encrypted, err := pdf.Decrypt(pdfPath, decryptedPath, passwords.For(sender))
+	if errors.Is(err, pdf.ErrPasswordMissing) {
+		l.Warn().Err(err).Str("filename", attachment.Filename).Str("sender", sender).Msg("Couldn't decrypt the PDF, it goes to review")
+		return &pdf.Document{Encrypted: true}, nil
+	}
+	// Broken rather than locked, a password won't help.
+	if err != nil {
+		l.Error().Err(err).Str("filename", attachment.Filename).Msg("Error decrypting PDF")
+		l.Print("Continuing with the PDF only.")
+		report := &pdf.NormalizeReport{Steps: []pdf.StepReport{{Name: pdf.STEP_DECRYPT, Error: err.Error()}}}
+		return &pdf.Document{Normalization: report}, nil
+	}
+
+	var decrypted []byte
+	if encrypted {
+		l.Print("Decrypted ", attachment.Filename, " with the password of ", sender, ".")
+		decrypted, err = os.ReadFile(decryptedPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the decrypted PDF: %v", err)
+		}
+		pdfPath = decryptedPath
+	}
+
+	normalizedPath := ws.Path("normalized.pdf")
+	report, err := pdf.Normalize(pdfPath, normalizedPath, options)
+	l.Print("Normalized ", attachment.Filename, ": ", report)
+	if err != nil {
+		l.Warn().Err(err).Str("filename", attachment.Filename).Msg("Failed to normalize the PDF, reading the original")
+		normalizedPath = ""
+	}
+
+	// The cleaned up copy is decrypted, it's archived only when the decrypted
+	// copy may be.
+	var archive []byte
+	if encrypted && archiveDecrypted {
+		archive = decrypted
+	}
+	if normalizedPath != "" && options.Cleanup && (!encrypted || archiveDecrypted) {
+		archive, err = os.ReadFile(normalizedPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the cleaned up PDF: %v", err)
+		}
+	}
+
+	ocrDir, err := ws.Mkdir("ocr")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range []string{normalizedPath, pdfPath} {
+		if path == "" {
+			continue
+		}
+
+		document, err := extractTextFromPDF(path, ocrDir)
+		if err != nil {
+			l.Error().Err(err).Str("filename", attachment.Filename).Msg("Error extracting text from PDF")
+			continue
+		}
+		document.Normalization = report
+		document.Archive = archive
+		document.Encrypted = encrypted
+		document.Decrypted = decrypted
+		return document, nil
+	}
+
+	l.Print("Continuing with the PDF only.")
+	return &pdf.Document{Normalization: report, Archive: archive, Encrypted: encrypted, Decrypted: decrypted}, nil
+}
+
+func newAnthropicClient() (*ai.AnthropicClient, *ai.UsageLedger, error) {
+	aiConfig, err := ai.LoadConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading AI config: %v", err)
+	}
+	aiConfig.Log()
+
+	cache, err := ai.LoadCache()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading AI cache: %v", err)
+	}
+
+	ledger, err := ai.LoadUsageLedger()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading AI usage: %v", err)
+	}
+
+	return ai.NewClient(
+		env.Get("ANTHROPIC_KEY"),
+		ai.WithConfig(aiConfig),
+		ai.WithCache(cache),
+		ai.WithUsageLedger(ledger),
+	), ledger, nil
+}
+
+func logUsage(ledger *ai.UsageLedger) {
+	run := ledger.Run()
+	month := ledger.Month(time.Now())
+
+	l.Print(
+		"AI usage in this run: ", run.Requests, " requests, ",
+		run.InputTokens, " input / ", run.OutputTokens, " output tokens, ",
+		fmt.Sprintf("$%.4f", run.Cost), ". This month: ", fmt.Sprintf("$%.2f", month.Cost), ".",
+	)
+}
+
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "cache":
+		if len(args) < 2 || args[1] != "clear" {
+			return fmt.Errorf("usage: cache clear")
+		}
+
+		cache, err := ai.LoadCache()
+		if err != nil {
+			return err
+		}
+
+		removed, err := cache.Clear()
+		if err != nil {
+			return err
+		}
+
+		l.Print("Removed ", removed, " cached responses.")
+		return nil
+	case "review":
+		return runReviewCommand(ctx, args[1:])
+	case "eval":
+		return runEvalCommand(ctx, args[1:], os.Stdout)
+	case "backfill":
+		return runBackfillCommand(ctx, args[1:])
+	case "ask":
+		return runAskCommand(ctx, args[1:])
+	case "password":
+		return runPasswordCommand(args[1:])
+	case "usage":
+		ledger, err := ai.LoadUsageLedger()
+		if err != nil {
+			return err
+		}
+
+		l.Print("AI usage per month: ", utils.PrettyPrint(ledger.Months))
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	if os.Getenv("ENV") == "development" {
 		l.Print("Loading .env file...")
@@ -207,37 +883,73 @@ func main() {
 		}
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1:]); err != nil {
+			l.Error().Err(err).Msg("Command failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	for range 10 {
+		l.Print("#################################")
+	}
+
+	l.Print("Starting invoice sorting...")
+
+	if err := sortInvoices(ctx); err != nil {
+		l.Fatal().Err(err).Msg("Invoice sorting failed")
+	}
+}
+
+// sortInvoices files the invoices of the emails since the last run. It
+// returns the errors to main, so the usage of the run is logged first.
+func sortInvoices(ctx context.Context) error {
+	anthropicClient, ledger, err := newAnthropicClient()
+	if err != nil {
+		return fmt.Errorf("error creating AI client: %v", err)
+	}
+	defer logUsage(ledger)
+
+	passwords, err := pdf.LoadPasswords()
+	if err != nil {
+		return fmt.Errorf("error loading PDF passwords: %v", err)
+	}
+
 	lastRun, _ := state.LoadLastRun()
 
 	l.Print("Starting fetching email invoices.")
 	emailMessages, err := getEmailInvoices(lastRun)
 	if err != nil {
-		l.Fatal().Err(err).Msg("Error fetching email invoices")
+		return fmt.Errorf("error fetching email invoices: %v", err)
 	}
 
 	for _, emailMessage := range emailMessages {
 		for _, attachment := range emailMessage.Attachments {
-			if strings.HasSuffix(strings.ToLower(attachment.Filename), ".pdf") {
-				l.Print("Processing PDF attachment: ", attachment.Filename)
-				pdfText, err := extractTextFromPDF(attachment.Content)
+			if ctx.Err() != nil {
+				l.Print("Interrupted, stopping without saving the last run.")
+				return nil
+			}
+
+			document, err := attachmentDocument(&attachment, emailMessage.SenderAddress(), passwords)
+			if err != nil {
+				return fmt.Errorf("error extracting text from attachment: %v", err)
+			}
+			if document != nil {
+				l.Print("Processing attachment: ", attachment.Filename)
+				err = analyzeAttachment(ctx, anthropicClient, document, emailMessage, &attachment)
 
 				if err != nil {
-					l.Print("Upgrading PDF version...")
-					v14, err := upgradePDFVersion()
-					if err != nil {
-						l.Fatal().Err(err).Msg("Error upgrading PDF version")
+					if ctx.Err() != nil {
+						l.Print("Interrupted, stopping without saving the last run.")
+						return nil
 					}
-
-					pdfText, err = extractTextFromPDF(v14)
-					if err != nil {
-						l.Fatal().Err(err).Msg("Error extracting text from PDF")
+					if errors.Is(err, ai.ErrBudgetExceeded) {
+						l.Error().Err(err).Msg("Stopping, the invoices will be picked up once the budget allows")
+						notifications.SendAlert("InvoiceGoSortSort stopped! " + err.Error())
+						return nil
 					}
-				}
-
-				err = analyzeAttachment(pdfText, &attachment)
-
-				if err != nil {
-					l.Fatal().Err(err).Msg("Error analyzing attachment")
+					return fmt.Errorf("error analyzing attachment: %v", err)
 				}
 			}
 		}
@@ -245,8 +957,9 @@ func main() {
 
 	err = state.SaveLastRun()
 	if err != nil {
-		l.Fatal().Err(err).Msg("Error saving last run")
+		return fmt.Errorf("error saving last run: %v", err)
 	}
 
 	l.Print("Finished!")
+	return nil
 }
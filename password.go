@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+)
+
+const passwordUsage = `usage:
+  password list
+  password set <address or domain> <password>
+  password remove <address or domain>`
+
+// runPasswordCommand manages the passwords of the encrypted PDFs, by the
+// sender address or domain.
+func runPasswordCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(passwordUsage)
+	}
+
+	passwords, err := pdf.LoadPasswords()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		keys := passwords.Keys()
+		if len(keys) == 0 {
+			l.Print("No passwords.")
+			return nil
+		}
+
+		// Never the passwords themselves, the output ends up in the logs.
+		for _, key := range keys {
+			l.Print(key)
+		}
+		return nil
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf(passwordUsage)
+		}
+
+		if err := passwords.Set(args[1], args[2]); err != nil {
+			return err
+		}
+		l.Print("Saved the password for ", args[1], ".")
+		return nil
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf(passwordUsage)
+		}
+
+		if err := passwords.Remove(args[1]); err != nil {
+			return err
+		}
+		l.Print("Removed the password for ", args[1], ".")
+		return nil
+	default:
+		return fmt.Errorf(passwordUsage)
+	}
+}
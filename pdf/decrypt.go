@@ -0,0 +1,122 @@
+package pdf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/krol22/invoice_go_sort_sort/env"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// ErrPasswordMissing means the PDF is encrypted and none of the passwords of
+// the sender opens it.
+var ErrPasswordMissing = errors.New("the PDF is encrypted and there is no password for it")
+
+// ArchiveDecrypted reads PDF_ARCHIVE_DECRYPTED, on to archive the decrypted
+// copy of an encrypted PDF. By default the original is archived as it came.
+func ArchiveDecrypted() (bool, error) {
+  switch value := env.Get("PDF_ARCHIVE_DECRYPTED"); value {
+  case "", "off":
+    return false, nil
+  case "on":
+    return true, nil
+  default:
+    return false, fmt.Errorf("invalid PDF_ARCHIVE_DECRYPTED, use on or off: %s", value)
+  }
+}
+
+// Decrypt writes the decrypted PDF to the output path and tells if it was
+// encrypted at all; when it wasn't, nothing is written. The passwords are
+// tried both as the user and the owner one. A PDF with an owner password
+// only, restricting e.g. the printing, opens without any.
+func Decrypt(input string, output string, passwords []string) (bool, error) {
+  encrypted, err := isEncrypted(input)
+  if err != nil {
+    return false, err
+  }
+  if !encrypted {
+    return false, nil
+  }
+
+  for _, password := range append([]string{""}, passwords...) {
+    err := decrypt(input, output, password)
+    if err == nil {
+      return true, nil
+    }
+    if !errors.Is(err, pdfcpu.ErrWrongPassword) {
+      return true, fmt.Errorf("error decrypting PDF: %v", err)
+    }
+  }
+
+  if len(passwords) > 0 {
+    return true, fmt.Errorf("%w, tried %d passwords", ErrPasswordMissing, len(passwords))
+  }
+  return true, ErrPasswordMissing
+}
+
+// decrypt does what api.DecryptFile does, and fixes the lengths of the
+// streams: pdfcpu keeps the ones of the encrypted streams, and the other
+// readers read past the end of the decrypted ones.
+func decrypt(input string, output string, password string) error {
+  file, err := os.Open(input)
+  if err != nil {
+    return fmt.Errorf("error opening PDF: %v", err)
+  }
+  defer file.Close()
+
+  conf := model.NewDefaultConfiguration()
+  conf.UserPW = password
+  conf.OwnerPW = password
+  conf.Offline = true
+  conf.Cmd = model.DECRYPT
+
+  ctx, err := api.ReadValidateAndOptimize(file, conf)
+  if err != nil {
+    return err
+  }
+
+  for _, entry := range ctx.Table {
+    if entry == nil {
+      continue
+    }
+    if stream, ok := entry.Object.(types.StreamDict); ok && stream.StreamLength != nil {
+      stream.Dict["Length"] = types.Integer(*stream.StreamLength)
+    }
+  }
+
+  return api.WriteContextFile(ctx, output)
+}
+
+// isEncrypted reads the PDF without any password: pdfcpu fails on the wrong
+// one, and reads the PDFs with an owner password only.
+func isEncrypted(path string) (encrypted bool, err error) {
+  // pdfcpu panics on some of the broken files.
+  defer func() {
+    if r := recover(); r != nil {
+      encrypted, err = false, nil
+    }
+  }()
+
+  file, err := os.Open(path)
+  if err != nil {
+    return false, fmt.Errorf("error opening PDF: %v", err)
+  }
+  defer file.Close()
+
+  conf := model.NewDefaultConfiguration()
+  conf.Offline = true
+  ctx, err := api.ReadContext(file, conf)
+  if errors.Is(err, pdfcpu.ErrWrongPassword) {
+    return true, nil
+  }
+  // Broken, the normalization reports it.
+  if err != nil {
+    return false, nil
+  }
+
+  return ctx.Encrypt != nil, nil
+}
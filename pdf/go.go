@@ -0,0 +1,126 @@
+package pdf
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	gopdf "github.com/ledongthuc/pdf"
+)
+
+// GoExtractor reads the text without any external tools. It lays the glyphs
+// out by their positions, the order in the content stream is often random.
+type GoExtractor struct{}
+
+func (e *GoExtractor) Name() string {
+  return EXTRACTOR_GO
+}
+
+func (e *GoExtractor) Extract(path string) ([]string, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, fmt.Errorf("error opening PDF: %v", err)
+  }
+  defer file.Close()
+
+  info, err := file.Stat()
+  if err != nil {
+    return nil, fmt.Errorf("error opening PDF: %v", err)
+  }
+
+  reader, err := newReader(file, info.Size())
+  if err != nil {
+    return nil, fmt.Errorf("error reading PDF: %v", err)
+  }
+
+  pages := make([]string, reader.NumPage())
+  for i := range pages {
+    page := reader.Page(i + 1)
+    if page.V.IsNull() {
+      continue
+    }
+
+    pages[i], err = pageText(page)
+    if err != nil {
+      return nil, fmt.Errorf("error reading page %d: %v", i + 1, err)
+    }
+  }
+
+  l.Print("Extracted ", len(pages), " pages with the Go extractor.")
+  return pages, nil
+}
+
+// The library panics on the malformed files.
+func newReader(file *os.File, size int64) (reader *gopdf.Reader, err error) {
+  defer func() {
+    if r := recover(); r != nil {
+      err = fmt.Errorf("%v", r)
+    }
+  }()
+
+  return gopdf.NewReader(file, size)
+}
+
+type line struct {
+  y float64
+  glyphs []gopdf.Text
+}
+
+func pageText(page gopdf.Page) (text string, err error) {
+  defer func() {
+    if r := recover(); r != nil {
+      err = fmt.Errorf("%v", r)
+    }
+  }()
+
+  glyphs := page.Content().Text
+  // Top to bottom, the Y axis goes up.
+  sort.SliceStable(glyphs, func(i, j int) bool {
+    return glyphs[i].Y > glyphs[j].Y
+  })
+
+  lines := []*line{}
+  for _, glyph := range glyphs {
+    if strings.TrimSpace(glyph.S) == "" && glyph.S != " " {
+      continue
+    }
+
+    // Glyphs on the same baseline, give or take a subscript.
+    tolerance := math.Max(glyph.FontSize, 1) / 2
+    if n := len(lines); n > 0 && math.Abs(lines[n - 1].y - glyph.Y) <= tolerance {
+      lines[n - 1].glyphs = append(lines[n - 1].glyphs, glyph)
+      continue
+    }
+    lines = append(lines, &line{y: glyph.Y, glyphs: []gopdf.Text{glyph}})
+  }
+
+  texts := make([]string, len(lines))
+  for i, line := range lines {
+    texts[i] = lineText(line.glyphs)
+  }
+  return strings.Join(texts, "\n"), nil
+}
+
+// lineText puts a space where the gap between the glyphs is wider than a
+// fraction of the font size, many PDFs don't have the spaces at all.
+func lineText(glyphs []gopdf.Text) string {
+  sort.SliceStable(glyphs, func(i, j int) bool {
+    return glyphs[i].X < glyphs[j].X
+  })
+
+  var text strings.Builder
+  for i, glyph := range glyphs {
+    if i > 0 {
+      previous := glyphs[i - 1]
+      gap := glyph.X - (previous.X + previous.W)
+      if gap > math.Max(glyph.FontSize, 1) * 0.2 && previous.S != " " && glyph.S != " " {
+        text.WriteString(" ")
+      }
+    }
+    text.WriteString(glyph.S)
+  }
+
+  return strings.TrimSpace(text.String())
+}
@@ -0,0 +1,104 @@
+// Package pdf extracts the text of the PDF documents, page by page.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/krol22/invoice_go_sort_sort/env"
+	"github.com/krol22/invoice_go_sort_sort/log"
+)
+
+var l = log.Get()
+
+// Backends of PDF_EXTRACTOR.
+const (
+  // Pure Go, works everywhere.
+  EXTRACTOR_GO = "go"
+  // pdfminer's pdf2txt.py, needs Python.
+  EXTRACTOR_PDF2TXT = "pdf2txt"
+  // pdftotext of poppler.
+  EXTRACTOR_PDFTOTEXT = "pdftotext"
+)
+
+// Page breaks in the output of the command line tools.
+const PAGE_BREAK = "\f"
+
+// Extractor gets the text of every page of the PDF. A page without a text
+// layer (a scan) is an empty string.
+type Extractor interface {
+  Name() string
+  Extract(path string) ([]string, error)
+}
+
+// LoadExtractor picks the backend by PDF_EXTRACTOR, the Go one by default.
+// PDF_EXTRACTOR_PATH points to the binary of the external ones, when it's not
+// in the PATH.
+func LoadExtractor() (Extractor, error) {
+  return NewExtractor(env.Get("PDF_EXTRACTOR"), env.Get("PDF_EXTRACTOR_PATH"))
+}
+
+func NewExtractor(name string, binary string) (Extractor, error) {
+  switch name {
+  case "", EXTRACTOR_GO:
+    return &GoExtractor{}, nil
+  case EXTRACTOR_PDF2TXT:
+    if binary == "" {
+      binary = "pdf2txt.py"
+    }
+    return &CommandExtractor{name: name, binary: binary}, nil
+  case EXTRACTOR_PDFTOTEXT:
+    if binary == "" {
+      binary = "pdftotext"
+    }
+    // "-" writes to the standard output.
+    return &CommandExtractor{name: name, binary: binary, args: []string{"-layout", "-enc", "UTF-8"}, stdout: true}, nil
+  default:
+    return nil, fmt.Errorf("invalid PDF_EXTRACTOR, use %s, %s or %s: %s", EXTRACTOR_GO, EXTRACTOR_PDF2TXT, EXTRACTOR_PDFTOTEXT, name)
+  }
+}
+
+// CommandExtractor runs a command line tool that prints the text with the
+// pages separated by form feeds.
+type CommandExtractor struct {
+  name string
+  binary string
+  args []string
+  // Needs "-" after the path to print to the standard output.
+  stdout bool
+}
+
+func (e *CommandExtractor) Name() string {
+  return e.name
+}
+
+func (e *CommandExtractor) Extract(path string) ([]string, error) {
+  args := append(append([]string{}, e.args...), path)
+  if e.stdout {
+    args = append(args, "-")
+  }
+
+  l.Print("Executing ", e.binary)
+  cmd := exec.Command(e.binary, args...)
+
+  var stdout, stderr bytes.Buffer
+  cmd.Stdout = &stdout
+  cmd.Stderr = &stderr
+
+  if err := cmd.Run(); err != nil {
+    return nil, fmt.Errorf("error executing %s: %v\nStderr: %s", e.binary, err, stderr.String())
+  }
+
+  return splitPages(stdout.String()), nil
+}
+
+// splitPages drops the empty page after the last form feed.
+func splitPages(text string) []string {
+  pages := strings.Split(text, PAGE_BREAK)
+  if len(pages) > 1 && strings.TrimSpace(pages[len(pages) - 1]) == "" {
+    pages = pages[:len(pages) - 1]
+  }
+  return pages
+}
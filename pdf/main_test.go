@@ -0,0 +1,242 @@
+package pdf_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+	"github.com/krol22/invoice_go_sort_sort/pdf/pdftest"
+)
+
+func TestGoExtractorReturnsPages(t *testing.T) {
+  path := pdftest.Write(t,
+    []string{"FAKTURA VAT nr 1/03/2024", "Data wystawienia: 2024-03-15"},
+    []string{"Razem brutto: 123,00 PLN"},
+  )
+
+  extractor, err := pdf.NewExtractor("", "")
+  if err != nil {
+    t.Fatalf("NewExtractor: %v", err)
+  }
+
+  pages, err := extractor.Extract(path)
+  if err != nil {
+    t.Fatalf("Extract: %v", err)
+  }
+
+  want := []string{"FAKTURA VAT nr 1/03/2024\nData wystawienia: 2024-03-15", "Razem brutto: 123,00 PLN"}
+  if len(pages) != len(want) {
+    t.Fatalf("got %d pages, want %d: %q", len(pages), len(want), pages)
+  }
+  for i := range want {
+    if pages[i] != want[i] {
+      t.Errorf("page %d = %q, want %q", i+1, pages[i], want[i])
+    }
+  }
+}
+
+func TestGoExtractorRejectsBrokenFiles(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "broken.pdf")
+  os.WriteFile(path, []byte("%PDF-1.4\nnot really"), 0644)
+
+  extractor, _ := pdf.NewExtractor(pdf.EXTRACTOR_GO, "")
+  if _, err := extractor.Extract(path); err == nil {
+    t.Error("expected an error for a broken file")
+  }
+}
+
+func TestPdftotextExtractorSplitsPages(t *testing.T) {
+  if _, err := exec.LookPath("pdftotext"); err != nil {
+    t.Skip("pdftotext is not installed")
+  }
+
+  path := pdftest.Write(t, []string{"Strona 1"}, []string{"Strona 2"})
+  extractor, _ := pdf.NewExtractor(pdf.EXTRACTOR_PDFTOTEXT, "")
+
+  pages, err := extractor.Extract(path)
+  if err != nil {
+    t.Fatalf("Extract: %v", err)
+  }
+  if len(pages) != 2 || !strings.Contains(pages[1], "Strona 2") {
+    t.Errorf("pages = %q", pages)
+  }
+}
+
+func TestNewExtractorRejectsUnknownBackends(t *testing.T) {
+  if _, err := pdf.NewExtractor("ocr", ""); err == nil {
+    t.Error("expected an error")
+  }
+}
+
+func TestReadRunsOCROnScannedPages(t *testing.T) {
+  pdftest.FakeOCR(t, "FAKTURA VAT nr 2/03/2024 Data wystawienia: 15.03.2024")
+  path := pdftest.Write(t,
+    []string{"Warunki wspolpracy z dostawca uslug hostingowych, strona pierwsza"},
+    []string{},
+  )
+
+  extractor, _ := pdf.NewExtractor(pdf.EXTRACTOR_GO, "")
+  ocr, err := pdf.LoadOCR()
+  if err != nil || ocr == nil {
+    t.Fatalf("LoadOCR = %v, %v", ocr, err)
+  }
+
+  document, err := pdf.Read(path, extractor, ocr, t.TempDir())
+  if err != nil {
+    t.Fatalf("Read: %v", err)
+  }
+
+  if !document.OCR() || len(document.OCRPages) != 1 || document.OCRPages[0] != 2 {
+    t.Fatalf("OCR pages = %v, want only the scanned page 2", document.OCRPages)
+  }
+  want := "Warunki wspolpracy z dostawca uslug hostingowych, strona pierwsza" + pdf.PAGE_BREAK +
+    "[page 2, read by OCR]\nFAKTURA VAT nr 2/03/2024 Data wystawienia: 15.03.2024"
+  if text := document.Text(); text != want {
+    t.Errorf("text = %q, want %q", text, want)
+  }
+}
+
+func TestLoadOCR(t *testing.T) {
+  t.Setenv("ENV", "development")
+  t.Setenv("PDF_OCR", "off")
+  if ocr, err := pdf.LoadOCR(); ocr != nil || err != nil {
+    t.Errorf("LoadOCR = %v, %v, want no OCR when it's off", ocr, err)
+  }
+
+  t.Setenv("PDF_OCR", "on")
+  t.Setenv("TESSERACT_PATH", filepath.Join(t.TempDir(), "tesseract"))
+  if _, err := pdf.LoadOCR(); err == nil {
+    t.Error("expected an error when OCR is on and tesseract is missing")
+  }
+}
+
+func TestNormalizeRewritesValidPDFs(t *testing.T) {
+  path := pdftest.Write(t, []string{"FAKTURA VAT nr 1/03/2024"})
+  output := filepath.Join(t.TempDir(), "normalized.pdf")
+
+  report, err := pdf.Normalize(path, output, pdf.NormalizeOptions{})
+  if err != nil {
+    t.Fatalf("Normalize: %v", err)
+  }
+
+  steps := []string{}
+  for _, step := range report.Steps {
+    if !step.OK {
+      t.Errorf("step %s failed: %s", step.Name, step.Error)
+    }
+    steps = append(steps, step.Name)
+  }
+  if strings.Join(steps, ",") != "validate,optimize,rewrite" {
+    t.Errorf("steps = %v", steps)
+  }
+  if report.Version != "1.4" || report.OutputVersion != "1.7" || report.Pages != 1 {
+    t.Errorf("report = %+v, want one page rewritten from 1.4 to 1.7", report)
+  }
+
+  data, err := os.ReadFile(output)
+  if err != nil || !strings.HasPrefix(string(data), "%PDF-1.7") {
+    t.Fatalf("output isn't a PDF 1.7: %v", err)
+  }
+
+  extractor, _ := pdf.NewExtractor(pdf.EXTRACTOR_GO, "")
+  if pages, err := extractor.Extract(output); err != nil || len(pages) != 1 || pages[0] != "FAKTURA VAT nr 1/03/2024" {
+    t.Errorf("normalized text = %q, %v", pages, err)
+  }
+}
+
+func TestNormalizeCleansUpActiveContent(t *testing.T) {
+  path := pdftest.WriteCustom(t,
+    "/OpenAction 6 0 R /Names << /JavaScript << /Names [(init) 6 0 R] >> >> ",
+    []string{"<< /S /JavaScript /JS (app.alert\\('Zapłać'\\);) >>"},
+    []string{"FAKTURA VAT nr 1/03/2024"},
+  )
+  output := filepath.Join(t.TempDir(), "normalized.pdf")
+
+  report, err := pdf.Normalize(path, output, pdf.NormalizeOptions{Cleanup: true})
+  if err != nil {
+    t.Fatalf("Normalize: %v", err)
+  }
+
+  var cleanup *pdf.StepReport
+  for i := range report.Steps {
+    if report.Steps[i].Name == pdf.STEP_CLEANUP {
+      cleanup = &report.Steps[i]
+    }
+  }
+  if cleanup == nil || strings.Join(cleanup.Details, ",") != "OpenAction,JavaScript" {
+    t.Fatalf("cleanup = %+v, want the action and the script removed", cleanup)
+  }
+
+  data, _ := os.ReadFile(output)
+  if strings.Contains(string(data), "JavaScript") || strings.Contains(string(data), "OpenAction") {
+    t.Error("the output still has the script")
+  }
+}
+
+func TestNormalizeReportsBrokenFiles(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "broken.pdf")
+  os.WriteFile(path, []byte("%PDF-1.4\nnot really"), 0644)
+
+  report, err := pdf.Normalize(path, filepath.Join(t.TempDir(), "normalized.pdf"), pdf.NormalizeOptions{})
+  if err == nil {
+    t.Fatal("expected an error")
+  }
+  if len(report.Steps) != 2 || report.Steps[0].OK || report.Steps[1].Name != pdf.STEP_REPAIR || report.Steps[1].Error == "" {
+    t.Errorf("steps = %+v, want the failed validation and repair", report.Steps)
+  }
+}
+
+func TestDecryptTriesThePasswords(t *testing.T) {
+  plain := pdftest.Write(t, []string{"FAKTURA VAT nr 1/03/2024"})
+  encrypted := pdftest.Encrypt(t, plain, "1234567")
+  output := filepath.Join(t.TempDir(), "decrypted.pdf")
+
+  if ok, err := pdf.Decrypt(plain, output, nil); ok || err != nil {
+    t.Errorf("Decrypt of a plain PDF = %v, %v", ok, err)
+  }
+  if _, err := os.Stat(output); !os.IsNotExist(err) {
+    t.Error("wrote a plain PDF")
+  }
+
+  if ok, err := pdf.Decrypt(encrypted, output, []string{"000"}); !ok || !errors.Is(err, pdf.ErrPasswordMissing) {
+    t.Errorf("Decrypt with a wrong password = %v, %v, want ErrPasswordMissing", ok, err)
+  }
+
+  if ok, err := pdf.Decrypt(encrypted, output, []string{"000", "1234567"}); !ok || err != nil {
+    t.Fatalf("Decrypt = %v, %v", ok, err)
+  }
+  extractor, _ := pdf.NewExtractor(pdf.EXTRACTOR_GO, "")
+  if pages, err := extractor.Extract(output); err != nil || len(pages) != 1 || pages[0] != "FAKTURA VAT nr 1/03/2024" {
+    t.Errorf("decrypted text = %q, %v", pages, err)
+  }
+}
+
+func TestPasswordsBySenderAndDomain(t *testing.T) {
+  passwords, err := pdf.OpenPasswords(filepath.Join(t.TempDir(), "passwords.json"))
+  if err != nil {
+    t.Fatalf("OpenPasswords: %v", err)
+  }
+  for key, password := range map[string]string{"orange.pl": "domain", "Faktury@E.Orange.pl": "address"} {
+    if err := passwords.Set(key, password); err != nil {
+      t.Fatalf("Set: %v", err)
+    }
+  }
+  if err := passwords.Set("pl", "tld"); err == nil {
+    t.Error("expected an error for a key without a dot")
+  }
+
+  got := passwords.For("faktury@e.orange.pl")
+  if strings.Join(got, ",") != "address,domain" {
+    t.Errorf("For = %v, want the address first, then the domain", got)
+  }
+  if got := passwords.For("ebok@orange.pl"); strings.Join(got, ",") != "domain" {
+    t.Errorf("For = %v, want the domain", got)
+  }
+  if got := passwords.For("faktury@orange.com"); len(got) != 0 {
+    t.Errorf("For = %v, want none", got)
+  }
+}
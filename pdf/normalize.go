@@ -0,0 +1,210 @@
+package pdf
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/krol22/invoice_go_sort_sort/env"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// Steps of the normalization, in order.
+const (
+  // Decryption with the passwords of the sender, before the normalization.
+  // Only a failed one is in the report.
+  STEP_DECRYPT = "decrypt"
+  // Strict validation, most PDFs pass.
+  STEP_VALIDATE = "validate"
+  // Relaxed validation of the PDFs failing the strict one, pdfcpu fixes the
+  // common errors on the way, e.g. a broken cross reference table.
+  STEP_REPAIR = "repair"
+  // Removes the active content, see cleanup.
+  STEP_CLEANUP = "cleanup"
+  // Drops the duplicate fonts, images and resources.
+  STEP_OPTIMIZE = "optimize"
+  // Writes the PDF anew, pdfcpu always writes version 1.7 (2.0 stays 2.0).
+  STEP_REWRITE = "rewrite"
+)
+
+type NormalizeOptions struct {
+  // PDF/A-style cleanup: no scripts, actions or embedded files.
+  Cleanup bool
+}
+
+// LoadNormalizeOptions reads PDF_ARCHIVE_CLEANUP, on to archive the cleaned up
+// copy instead of the attachment as it came.
+func LoadNormalizeOptions() (NormalizeOptions, error) {
+  switch cleanup := env.Get("PDF_ARCHIVE_CLEANUP"); cleanup {
+  case "", "off":
+    return NormalizeOptions{}, nil
+  case "on":
+    return NormalizeOptions{Cleanup: true}, nil
+  default:
+    return NormalizeOptions{}, fmt.Errorf("invalid PDF_ARCHIVE_CLEANUP, use on or off: %s", cleanup)
+  }
+}
+
+type StepReport struct {
+  Name string `json:"name"`
+  OK bool `json:"ok"`
+  // What the step did, e.g. the removed scripts.
+  Details []string `json:"details,omitempty"`
+  Error string `json:"error,omitempty"`
+}
+
+// NormalizeReport is what the normalization did to the PDF, step by step.
+// A step that wasn't needed isn't in it.
+type NormalizeReport struct {
+  Version string `json:"version,omitempty"`
+  OutputVersion string `json:"outputVersion,omitempty"`
+  Pages int `json:"pages,omitempty"`
+  SizeBefore int64 `json:"sizeBefore"`
+  SizeAfter int64 `json:"sizeAfter,omitempty"`
+  Steps []StepReport `json:"steps"`
+}
+
+func (r *NormalizeReport) String() string {
+  steps := make([]string, len(r.Steps))
+  for i, step := range r.Steps {
+    steps[i] = step.Name
+    if !step.OK {
+      steps[i] += " failed"
+    }
+    if len(step.Details) > 0 {
+      steps[i] += " (" + strings.Join(step.Details, ", ") + ")"
+    }
+  }
+  return fmt.Sprintf("%s: %s, %d -> %d bytes", r.Version, strings.Join(steps, ", "), r.SizeBefore, r.SizeAfter)
+}
+
+func (r *NormalizeReport) add(name string, err error, details ...string) {
+  step := StepReport{Name: name, OK: err == nil, Details: details}
+  if err != nil {
+    step.Error = err.Error()
+  }
+  r.Steps = append(r.Steps, step)
+}
+
+// Normalize validates the PDF, repairs it if needs be, optimizes it and
+// writes it to the output path. The report is there on the errors too, with
+// the failed step last.
+func Normalize(input string, output string, options NormalizeOptions) (*NormalizeReport, error) {
+  report := &NormalizeReport{Steps: []StepReport{}}
+  if info, err := os.Stat(input); err == nil {
+    report.SizeBefore = info.Size()
+  }
+
+  ctx, err := readValidated(input, model.ValidationStrict)
+  report.add(STEP_VALIDATE, err)
+  if err != nil {
+    ctx, err = readValidated(input, model.ValidationRelaxed)
+    report.add(STEP_REPAIR, err)
+    if err != nil {
+      return report, fmt.Errorf("error repairing PDF: %v", err)
+    }
+  }
+  report.Version = ctx.XRefTable.Version().String()
+  report.Pages = ctx.PageCount
+
+  if options.Cleanup {
+    removed, err := cleanup(ctx)
+    report.add(STEP_CLEANUP, err, removed...)
+    if err != nil {
+      return report, fmt.Errorf("error cleaning up PDF: %v", err)
+    }
+  }
+
+  err = api.OptimizeContext(ctx)
+  report.add(STEP_OPTIMIZE, err)
+  if err != nil {
+    return report, fmt.Errorf("error optimizing PDF: %v", err)
+  }
+
+  err = api.WriteContextFile(ctx, output)
+  if err != nil {
+    report.add(STEP_REWRITE, err)
+    return report, fmt.Errorf("error writing PDF: %v", err)
+  }
+  report.OutputVersion = model.V17.String()
+  if ctx.XRefTable.Version() == model.V20 {
+    report.OutputVersion = model.V20.String()
+  }
+  report.add(STEP_REWRITE, nil, report.Version + " -> " + report.OutputVersion)
+  if info, err := os.Stat(output); err == nil {
+    report.SizeAfter = info.Size()
+  }
+
+  return report, nil
+}
+
+func readValidated(path string, mode int) (ctx *model.Context, err error) {
+  // pdfcpu panics on some of the broken files.
+  defer func() {
+    if r := recover(); r != nil {
+      err = fmt.Errorf("%v", r)
+    }
+  }()
+
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  conf := model.NewDefaultConfiguration()
+  conf.ValidationMode = mode
+  conf.Offline = true
+  return api.ReadAndValidate(file, conf)
+}
+
+// cleanup removes what PDF/A doesn't allow and an invoice doesn't need: the
+// scripts, the actions run on opening the document or a page, and the
+// embedded files. Returns what it removed.
+func cleanup(ctx *model.Context) ([]string, error) {
+  removed := []string{}
+
+  root, err := ctx.Catalog()
+  if err != nil {
+    return removed, err
+  }
+  for _, key := range []string{"OpenAction", "AA", "Collection"} {
+    if _, found := root.Find(key); found {
+      root.Delete(key)
+      removed = append(removed, key)
+    }
+  }
+
+  // NamesDict would create the dictionary when there's none.
+  if _, found := root.Find("Names"); found {
+    names, err := ctx.NamesDict()
+    if err != nil {
+      return removed, err
+    }
+    for _, tree := range []string{"JavaScript", "EmbeddedFiles"} {
+      if _, found := names.Find(tree); !found {
+        continue
+      }
+      // Or writing would bring it back.
+      delete(ctx.Names, tree)
+      if err := ctx.RemoveNameTree(tree); err != nil {
+        return removed, err
+      }
+      removed = append(removed, tree)
+    }
+  }
+
+  for page := 1; page <= ctx.PageCount; page++ {
+    dict, _, _, err := ctx.PageDict(page, false)
+    if err != nil {
+      return removed, err
+    }
+    if _, found := dict.Find("AA"); found {
+      dict.Delete("AA")
+      removed = append(removed, fmt.Sprintf("AA of page %d", page))
+    }
+  }
+
+  return removed, nil
+}
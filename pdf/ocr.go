@@ -0,0 +1,184 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/krol22/invoice_go_sort_sort/env"
+)
+
+// Tesseract language packs, the invoices are in Polish or English.
+const OCR_LANGUAGES = "pol+eng"
+
+// Dots per inch of the page images, tesseract reads 300 best.
+const OCR_RESOLUTION = 300
+
+// A page with less text than this has no text layer, it's a scan. A scanner
+// may still stamp a header or the page number on it.
+const MIN_PAGE_TEXT_LENGTH = 50
+
+// OCR reads the scanned pages: pdftoppm (poppler) renders the page, tesseract
+// reads the image.
+type OCR struct {
+  pdftoppm string
+  tesseract string
+}
+
+// LoadOCR reads PDF_OCR, on by default when pdftoppm and tesseract are
+// installed, and off to skip it. TESSERACT_PATH and PDFTOPPM_PATH point to
+// the binaries when they're not in the PATH. Nil means no OCR.
+func LoadOCR() (*OCR, error) {
+  setting := env.Get("PDF_OCR")
+  if setting == "off" {
+    return nil, nil
+  }
+  if setting != "" && setting != "on" {
+    return nil, fmt.Errorf("invalid PDF_OCR, use on or off: %s", setting)
+  }
+
+  ocr := &OCR{pdftoppm: env.Get("PDFTOPPM_PATH"), tesseract: env.Get("TESSERACT_PATH")}
+  if ocr.pdftoppm == "" {
+    ocr.pdftoppm = "pdftoppm"
+  }
+  if ocr.tesseract == "" {
+    ocr.tesseract = "tesseract"
+  }
+
+  for _, binary := range []string{ocr.pdftoppm, ocr.tesseract} {
+    if _, err := exec.LookPath(binary); err != nil {
+      // Asked for explicitly, it has to work.
+      if setting == "on" {
+        return nil, fmt.Errorf("PDF_OCR is on, but %s is missing: %v", binary, err)
+      }
+      l.Warn().Str("binary", binary).Msg("OCR is off, install poppler and tesseract with the pol and eng languages to read the scans")
+      return nil, nil
+    }
+  }
+
+  return ocr, nil
+}
+
+// Page renders the 1-based page of the PDF into the directory and reads its
+// text. The image stays there, in the workspace of the document.
+func (o *OCR) Page(path string, page int, dir string) (string, error) {
+  // -singlefile names the image exactly, without the page number.
+  image := filepath.Join(dir, "page")
+  number := strconv.Itoa(page)
+  render := exec.Command(o.pdftoppm, "-f", number, "-l", number, "-r", strconv.Itoa(OCR_RESOLUTION), "-gray", "-png", "-singlefile", path, image)
+  if err := runCommand(render); err != nil {
+    return "", err
+  }
+
+  return o.Image(image + ".png")
+}
+
+// Image reads the text of the image, a rendered page or a scan attached as
+// an image.
+func (o *OCR) Image(path string) (string, error) {
+  var stdout bytes.Buffer
+  cmd := exec.Command(o.tesseract, path, "stdout", "-l", OCR_LANGUAGES)
+  cmd.Stdout = &stdout
+  if err := runCommand(cmd); err != nil {
+    return "", err
+  }
+
+  return strings.TrimSpace(stdout.String()), nil
+}
+
+func runCommand(cmd *exec.Cmd) error {
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+  if err := cmd.Run(); err != nil {
+    return fmt.Errorf("error executing %s: %v\nStderr: %s", filepath.Base(cmd.Path), err, stderr.String())
+  }
+  return nil
+}
+
+// Document is the text of a PDF, page by page.
+type Document struct {
+  Pages []string
+  // 1-based, the pages read by OCR. Their text may have misread characters.
+  OCRPages []int
+  // What Normalize did before the reading, nil when it didn't run.
+  Normalization *NormalizeReport
+  // The PDF to archive instead of the attachment, e.g. the cleaned up copy.
+  // Nil keeps the attachment.
+  Archive []byte
+  // An encrypted PDF has the decrypted copy, for the model, unless there was
+  // no password for it.
+  Encrypted bool
+  Decrypted []byte
+}
+
+// NewDocument splits the text on the form feeds, for a text extracted
+// earlier.
+func NewDocument(text string) *Document {
+  return &Document{Pages: splitPages(text)}
+}
+
+// Read extracts the text of the PDF and reads the pages without a text layer
+// with the OCR, when it's given, rendering them into the directory. A page the
+// OCR fails on keeps what the extractor found, the model gets the PDF when
+// there isn't enough text.
+func Read(path string, extractor Extractor, ocr *OCR, dir string) (*Document, error) {
+  l.Print("Extracting text with ", extractor.Name())
+  pages, err := extractor.Extract(path)
+  if err != nil {
+    return nil, err
+  }
+
+  doc := &Document{Pages: pages}
+  if ocr == nil {
+    return doc, nil
+  }
+
+  for i, page := range pages {
+    if len(strings.TrimSpace(page)) >= MIN_PAGE_TEXT_LENGTH {
+      continue
+    }
+
+    l.Print("Page ", i + 1, " has no text layer, reading it with OCR.")
+    text, err := ocr.Page(path, i + 1, dir)
+    if err != nil {
+      l.Warn().Err(err).Int("page", i + 1).Msg("OCR failed, leaving the page out")
+      continue
+    }
+    // The little text the page had is in the image too.
+    if len(strings.TrimSpace(text)) > len(strings.TrimSpace(page)) {
+      doc.Pages[i] = text
+      doc.OCRPages = append(doc.OCRPages, i + 1)
+    }
+  }
+
+  return doc, nil
+}
+
+// Locked tells if the PDF is encrypted and we couldn't open it.
+func (d *Document) Locked() bool {
+  return d.Encrypted && d.Decrypted == nil
+}
+
+// OCR tells if any of the text comes from the OCR.
+func (d *Document) OCR() bool {
+  return len(d.OCRPages) > 0
+}
+
+// TextPages are the pages for the model and for the review: the pages read
+// by OCR start with a note saying so.
+func (d *Document) TextPages() []string {
+  pages := make([]string, len(d.Pages))
+  copy(pages, d.Pages)
+  for _, page := range d.OCRPages {
+    pages[page - 1] = fmt.Sprintf("[page %d, read by OCR]\n%s", page, pages[page - 1])
+  }
+  return pages
+}
+
+// Text joins the text pages the way the command line tools do.
+func (d *Document) Text() string {
+  return strings.Join(d.TextPages(), PAGE_BREAK)
+}
@@ -0,0 +1,124 @@
+package pdf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/krol22/invoice_go_sort_sort/state"
+)
+
+// Passwords of the encrypted PDFs, by the sender address or its domain. The
+// telecoms and the banks use the customer number, the same for every invoice.
+type Passwords struct {
+  path string
+  Passwords map[string]string `json:"passwords"`
+}
+
+func LoadPasswords() (*Passwords, error) {
+  dir, err := state.Dir()
+  if err != nil {
+    return nil, err
+  }
+
+  return OpenPasswords(filepath.Join(dir, "pdf_passwords.json"))
+}
+
+func OpenPasswords(path string) (*Passwords, error) {
+  passwords := &Passwords{path: path, Passwords: map[string]string{}}
+
+  data, err := os.ReadFile(path)
+  if os.IsNotExist(err) {
+    return passwords, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("error reading passwords: %v", err)
+  }
+
+  if err := json.Unmarshal(data, passwords); err != nil {
+    return nil, fmt.Errorf("error unmarshalling passwords: %v", err)
+  }
+  if passwords.Passwords == nil {
+    passwords.Passwords = map[string]string{}
+  }
+
+  return passwords, nil
+}
+
+// For returns the passwords to try for the sender: of the address first,
+// then of its domain and the parent domains, e.g. for faktury@e.orange.pl
+// the ones of e.orange.pl and orange.pl.
+func (p *Passwords) For(sender string) []string {
+  candidates := []string{}
+  for _, key := range passwordKeys(sender) {
+    if password, ok := p.Passwords[key]; ok {
+      candidates = append(candidates, password)
+    }
+  }
+  return candidates
+}
+
+func passwordKeys(sender string) []string {
+  sender = strings.ToLower(strings.TrimSpace(sender))
+  at := strings.LastIndex(sender, "@")
+  if at < 0 {
+    return nil
+  }
+
+  keys := []string{sender}
+  domain := sender[at + 1:]
+  // Down to the second-level domain, nobody has a password for "pl".
+  for strings.Contains(domain, ".") {
+    keys = append(keys, domain)
+    domain = domain[strings.Index(domain, ".") + 1:]
+  }
+  return keys
+}
+
+// Set saves the password for the address or the domain.
+func (p *Passwords) Set(key string, password string) error {
+  key = strings.ToLower(strings.TrimSpace(key))
+  if key == "" || !strings.Contains(key, ".") || password == "" {
+    return fmt.Errorf("usage: an address or a domain, e.g. faktury@orange.pl or orange.pl, and the password")
+  }
+
+  p.Passwords[key] = password
+  return p.save()
+}
+
+func (p *Passwords) Remove(key string) error {
+  key = strings.ToLower(strings.TrimSpace(key))
+  if _, ok := p.Passwords[key]; !ok {
+    return fmt.Errorf("no password for %s", key)
+  }
+
+  delete(p.Passwords, key)
+  return p.save()
+}
+
+// Keys lists the addresses and domains with a password, not the passwords.
+func (p *Passwords) Keys() []string {
+  keys := make([]string, 0, len(p.Passwords))
+  for key := range p.Passwords {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+func (p *Passwords) save() error {
+  data, err := json.MarshalIndent(p, "", "  ")
+  if err != nil {
+    return fmt.Errorf("error marshalling passwords: %v", err)
+  }
+
+  // Only for us, like the rest of the state.
+  if err := os.WriteFile(p.path, data, 0600); err != nil {
+    return fmt.Errorf("error writing passwords: %v", err)
+  }
+
+  return nil
+}
@@ -0,0 +1,104 @@
+// Package pdftest writes the PDFs for the tests.
+package pdftest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// Write writes a minimal PDF to a temporary directory of the test, with a
+// page for every list of lines. The lines are in the reverse order in the
+// content stream, like many generators do.
+func Write(t *testing.T, pages ...[]string) string {
+  t.Helper()
+  return WriteCustom(t, "", nil, pages...)
+}
+
+// WriteCustom adds the entries to the catalog, and the objects after the
+// pages: with a page they start at 6 0 R.
+func WriteCustom(t *testing.T, catalog string, extra []string, pages ...[]string) string {
+  t.Helper()
+
+  objects := []string{
+    "<< /Type /Catalog /Pages 2 0 R " + catalog + ">>",
+    "", // the page tree, when the pages are known
+    "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+  }
+
+  kids := []string{}
+  for _, lines := range pages {
+    var content strings.Builder
+    for i := len(lines) - 1; i >= 0; i-- {
+      fmt.Fprintf(&content, "BT /F1 12 Tf 1 0 0 1 72 %d Tm (%s) Tj ET\n", 720-i*14, lines[i])
+    }
+    objects = append(objects, fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+    contentRef := len(objects)
+
+    objects = append(objects, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", contentRef))
+    kids = append(kids, fmt.Sprintf("%d 0 R", len(objects)))
+  }
+  objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+  objects = append(objects, extra...)
+
+  var buf strings.Builder
+  buf.WriteString("%PDF-1.4\n")
+  offsets := make([]int, len(objects))
+  for i, object := range objects {
+    offsets[i] = buf.Len()
+    fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+  }
+
+  xref := buf.Len()
+  fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+  for _, offset := range offsets {
+    fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+  }
+  fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+  path := filepath.Join(t.TempDir(), "faktura.pdf")
+  if err := os.WriteFile(path, []byte(buf.String()), 0644); err != nil {
+    t.Fatal(err)
+  }
+  return path
+}
+
+// Encrypt writes an AES encrypted copy of the PDF, opened with the password.
+func Encrypt(t *testing.T, path string, password string) string {
+  t.Helper()
+
+  encrypted := filepath.Join(t.TempDir(), "encrypted.pdf")
+  conf := model.NewAESConfiguration(password, password + "-owner", 256)
+  if err := api.EncryptFile(path, encrypted, conf); err != nil {
+    t.Fatalf("EncryptFile: %v", err)
+  }
+  return encrypted
+}
+
+// FakeOCR points PDF_OCR to scripts standing in for pdftoppm and tesseract,
+// the tesseract one prints the text.
+func FakeOCR(t *testing.T, text string) {
+  t.Helper()
+
+  dir := t.TempDir()
+  scripts := map[string]string{
+    // The image is the last argument.
+    "pdftoppm": "#!/bin/sh\nfor last; do :; done\ntouch \"$last.png\"\n",
+    "tesseract": "#!/bin/sh\ntest -f \"$1\" || exit 1\nprintf '%s\\n' '" + text + "'\n",
+  }
+  for name, script := range scripts {
+    if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  t.Setenv("ENV", "development")
+  t.Setenv("PDF_OCR", "on")
+  t.Setenv("PDFTOPPM_PATH", filepath.Join(dir, "pdftoppm"))
+  t.Setenv("TESSERACT_PATH", filepath.Join(dir, "tesseract"))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/ai/llm"
+	"github.com/krol22/invoice_go_sort_sort/email"
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+	"github.com/krol22/invoice_go_sort_sort/review"
+)
+
+const reviewUsage = `usage:
+  review list
+  review approve <file>
+  review correct <file> <YYYY-MM-DD>
+  review retry <file>`
+
+func runReviewCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(reviewUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		entries, err := review.List()
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			l.Print("Nothing to review.")
+			return nil
+		}
+
+		for _, entry := range entries {
+			date, _ := entry.Output["date"].(string)
+			if date == "" {
+				date = "-"
+			}
+			label := string(entry.Label)
+			if label == "" {
+				label = "-"
+			}
+			l.Print(
+				entry.Filename, " | ", label, " | proposed date: ", date, " | ", entry.Reason,
+				": ", strings.Join(entry.Details, "; "),
+			)
+		}
+		return nil
+	case "approve":
+		if len(args) != 2 {
+			return fmt.Errorf(reviewUsage)
+		}
+
+		entry, _, err := review.Get(args[1])
+		if err != nil {
+			return err
+		}
+
+		date, _ := entry.Output["date"].(string)
+		if date == "" {
+			return fmt.Errorf("%s has no proposed date, use review correct", args[1])
+		}
+		return fileReviewed(args[1], date)
+	case "correct":
+		if len(args) != 3 {
+			return fmt.Errorf(reviewUsage)
+		}
+		return fileReviewed(args[1], args[2])
+	case "retry":
+		if len(args) != 2 {
+			return fmt.Errorf(reviewUsage)
+		}
+
+		passwords, err := pdf.LoadPasswords()
+		if err != nil {
+			return err
+		}
+		anthropicClient, ledger, err := newAnthropicClient()
+		if err != nil {
+			return err
+		}
+		defer logUsage(ledger)
+
+		return retryReviewed(ctx, anthropicClient, passwords, args[1])
+	default:
+		return fmt.Errorf(reviewUsage)
+	}
+}
+
+// fileReviewed files the document under the given date and removes it from
+// the review folder. Unclassified documents are filed as regular invoices.
+func fileReviewed(filename string, invoiceDate string) error {
+	entry, content, err := review.Get(filename)
+	if err != nil {
+		return err
+	}
+
+	label := entry.Label
+	if label == "" {
+		label = llm.LABEL_VAT_INVOICE
+	}
+
+	path, err := fileInvoice(label, invoiceDate, entry.Filename, content)
+	if err != nil {
+		return err
+	}
+	indexInvoice(path, label, invoiceDate, entry.Text, entry.Output, entry.ReceivedAt)
+
+	return review.Remove(entry.Filename)
+}
+
+// retryReviewed analyses the document again, e.g. once the password of the
+// encrypted PDF is set. It's filed, or back in the review with a new entry.
+func retryReviewed(ctx context.Context, client *ai.AnthropicClient, passwords *pdf.Passwords, filename string) error {
+	entry, content, err := review.Get(filename)
+	if err != nil {
+		return err
+	}
+	if entry.Email == nil {
+		return fmt.Errorf("%s has no email saved with it, use review correct", filename)
+	}
+
+	emailMessage := reviewedEmail(entry)
+	attachment := &email.Attachment{Filename: entry.Filename, Content: content}
+	document, err := attachmentDocument(attachment, emailMessage.SenderAddress(), passwords)
+	if err != nil {
+		return err
+	}
+	if document == nil {
+		return fmt.Errorf("%s is neither a PDF nor a scan, use review correct", filename)
+	}
+
+	doc, err := newInvoiceDocument(emailMessage, attachment, document)
+	if err != nil {
+		return err
+	}
+
+	// Out of the way of the new entry, and back unless the document is filed
+	// or in the review again: a skipped one would be lost.
+	if err := review.Remove(entry.Filename); err != nil {
+		return err
+	}
+	err = sortDocument(ctx, client, doc)
+	if err == nil && doc.sorted {
+		return nil
+	}
+	if _, addErr := review.Add(content, entry); addErr != nil {
+		l.Error().Err(addErr).Str("filename", entry.Filename).Msg("Failed to put the document back to review")
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s isn't a document we file, left it in the review, use review correct to file it anyway", filename)
+}
+
+// reviewedEmail is the email of the entry, as far as the analysis needs it.
+func reviewedEmail(entry *review.Entry) *email.EmailMessage {
+	envelope := &imap.Envelope{Date: entry.ReceivedAt, Subject: entry.Email.Subject}
+	if from, err := mail.ParseAddress(entry.Email.From); err == nil {
+		mailbox, host, _ := strings.Cut(from.Address, "@")
+		envelope.From = []*imap.Address{{PersonalName: from.Name, MailboxName: mailbox, HostName: host}}
+	}
+
+	return &email.EmailMessage{Message: &imap.Message{Envelope: envelope}, Body: entry.Email.Body}
+}
@@ -0,0 +1,205 @@
+package review
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krol22/invoice_go_sort_sort/ai"
+	"github.com/krol22/invoice_go_sort_sort/ai/llm"
+	"github.com/krol22/invoice_go_sort_sort/env"
+	"github.com/krol22/invoice_go_sort_sort/log"
+	"github.com/krol22/invoice_go_sort_sort/pdf"
+)
+
+var l = log.Get()
+
+// Documents we couldn't file automatically wait in this folder, each with a
+// JSON sidecar explaining why.
+const FOLDER = "_do_sprawdzenia"
+
+const DEFAULT_CONFIDENCE_THRESHOLD = 0.7
+
+type Entry struct {
+  Filename string `json:"filename"`
+  Reason string `json:"reason"`
+  Details []string `json:"details,omitempty"`
+  // What the model answered, if anything.
+  Output map[string]interface{} `json:"output,omitempty"`
+  Confidence map[string]llm.FieldConfidence `json:"confidence,omitempty"`
+  // Empty when the document couldn't be classified.
+  Label llm.DocumentLabel `json:"label,omitempty"`
+  PromptVersion string `json:"promptVersion,omitempty"`
+  // The models each routed task went through.
+  Routes map[string][]ai.RouteStep `json:"routes,omitempty"`
+  // The text of the document, for the index once it's filed.
+  Text string `json:"text,omitempty"`
+  // How a document too long to send whole was sent.
+  LongDocument *llm.DocumentStrategy `json:"longDocument,omitempty"`
+  // The scanned pages, read by OCR.
+  OCRPages []int `json:"ocrPages,omitempty"`
+  // What the normalization did to the PDF.
+  Normalization *pdf.NormalizeReport `json:"normalization,omitempty"`
+  // The email the document came with, to analyse it again with review retry.
+  Email *Email `json:"email,omitempty"`
+  ReceivedAt time.Time `json:"receivedAt"`
+  CreatedAt time.Time `json:"createdAt"`
+}
+
+// Email is what the analysis reads of the email, see llm.EmailContext.
+type Email struct {
+  Subject string `json:"subject,omitempty"`
+  // The name and the address of the sender, e.g. Orange <faktury@orange.pl>.
+  From string `json:"from,omitempty"`
+  // Trimmed to what the sender wrote.
+  Body string `json:"body,omitempty"`
+}
+
+func Dir() string {
+  return filepath.Join(env.Get("ICLOUD_PATH"), "Documents", "Firma", FOLDER)
+}
+
+// ConfidenceThreshold reads REVIEW_CONFIDENCE_THRESHOLD, documents scored
+// below it go to the review.
+func ConfidenceThreshold() (float64, error) {
+  value := env.Get("REVIEW_CONFIDENCE_THRESHOLD")
+  if value == "" {
+    return DEFAULT_CONFIDENCE_THRESHOLD, nil
+  }
+
+  threshold, err := strconv.ParseFloat(value, 64)
+  if err != nil || threshold < 0 || threshold > 1 {
+    return 0, fmt.Errorf("invalid REVIEW_CONFIDENCE_THRESHOLD: %s", value)
+  }
+  return threshold, nil
+}
+
+func sidecarPath(documentPath string) string {
+  return documentPath + ".json"
+}
+
+// Add puts the document into the review folder and returns its path.
+func Add(content []byte, entry *Entry) (string, error) {
+  dir := Dir()
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return "", fmt.Errorf("error creating review folder: %v", err)
+  }
+
+  documentPath := uniquePath(filepath.Join(dir, entry.Filename))
+  entry.Filename = filepath.Base(documentPath)
+  entry.CreatedAt = time.Now()
+
+  if err := os.WriteFile(documentPath, content, 0644); err != nil {
+    return "", fmt.Errorf("error saving document for review: %v", err)
+  }
+
+  sidecar, err := json.MarshalIndent(entry, "", "  ")
+  if err != nil {
+    return "", fmt.Errorf("error marshalling review entry: %v", err)
+  }
+
+  if err := os.WriteFile(sidecarPath(documentPath), sidecar, 0644); err != nil {
+    return "", fmt.Errorf("error saving review entry: %v", err)
+  }
+
+  l.Print("Document ", entry.Filename, " needs a review: ", entry.Reason)
+  return documentPath, nil
+}
+
+// List returns all the documents waiting for a review, oldest first.
+func List() ([]*Entry, error) {
+  files, err := os.ReadDir(Dir())
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("error reading review folder: %v", err)
+  }
+
+  var entries []*Entry
+  for _, file := range files {
+    if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+      continue
+    }
+
+    entry, err := readEntry(filepath.Join(Dir(), file.Name()))
+    if err != nil {
+      l.Error().Err(err).Str("file", file.Name()).Msg("Skipping broken review entry")
+      continue
+    }
+    entries = append(entries, entry)
+  }
+
+  sort.Slice(entries, func(i, j int) bool {
+    return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+  })
+
+  return entries, nil
+}
+
+// Get returns the entry and the document it's about.
+func Get(filename string) (*Entry, []byte, error) {
+  documentPath := filepath.Join(Dir(), filepath.Base(filename))
+
+  entry, err := readEntry(sidecarPath(documentPath))
+  if err != nil {
+    return nil, nil, err
+  }
+
+  content, err := os.ReadFile(documentPath)
+  if err != nil {
+    return nil, nil, fmt.Errorf("error reading document: %v", err)
+  }
+
+  return entry, content, nil
+}
+
+// Remove deletes the document and its sidecar, once it's been filed.
+func Remove(filename string) error {
+  documentPath := filepath.Join(Dir(), filepath.Base(filename))
+
+  if err := os.Remove(documentPath); err != nil {
+    return fmt.Errorf("error removing document: %v", err)
+  }
+  if err := os.Remove(sidecarPath(documentPath)); err != nil {
+    return fmt.Errorf("error removing review entry: %v", err)
+  }
+
+  return nil
+}
+
+func readEntry(path string) (*Entry, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("error reading review entry: %v", err)
+  }
+
+  entry := &Entry{}
+  if err := json.Unmarshal(data, entry); err != nil {
+    return nil, fmt.Errorf("error unmarshalling review entry: %v", err)
+  }
+
+  return entry, nil
+}
+
+// uniquePath appends a counter to the name when the file already exists, so
+// two invoices named "faktura.pdf" don't overwrite each other.
+func uniquePath(path string) string {
+  if _, err := os.Stat(path); os.IsNotExist(err) {
+    return path
+  }
+
+  ext := filepath.Ext(path)
+  base := strings.TrimSuffix(path, ext)
+  for i := 2; ; i++ {
+    candidate := fmt.Sprintf("%s_%d%s", base, i, ext)
+    if _, err := os.Stat(candidate); os.IsNotExist(err) {
+      return candidate
+    }
+  }
+}
@@ -0,0 +1,23 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Dir returns the directory for the files the app keeps between the runs,
+// creating it when necessary.
+func Dir() (string, error) {
+  configDir, err := os.UserConfigDir()
+  if err != nil {
+    return "", fmt.Errorf("error getting config directory: %v", err)
+  }
+
+  dir := filepath.Join(configDir, "com.krol22.invoice_go_sort_sort")
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return "", fmt.Errorf("error creating state directory: %v", err)
+  }
+
+  return dir, nil
+}
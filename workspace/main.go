@@ -0,0 +1,65 @@
+// Package workspace gives every document its own temporary directory. The
+// attachments are invoices, nothing of them may stay behind in /tmp.
+package workspace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/krol22/invoice_go_sort_sort/log"
+)
+
+var l = log.Get()
+
+// Workspace is a private directory, removed with everything in it on Close.
+// Close it in a defer right after New, so it goes on the errors too.
+type Workspace struct {
+  dir string
+}
+
+// New creates the directory, readable only by us, in the system temp
+// directory. Two documents never share one.
+func New() (*Workspace, error) {
+  dir, err := os.MkdirTemp("", "invoice_go_sort_sort_*")
+  if err != nil {
+    return nil, fmt.Errorf("error creating workspace: %v", err)
+  }
+  return &Workspace{dir: dir}, nil
+}
+
+func (w *Workspace) Dir() string {
+  return w.dir
+}
+
+// Path is where the file of the given name goes in the workspace.
+func (w *Workspace) Path(name string) string {
+  return filepath.Join(w.dir, filepath.Base(name))
+}
+
+// WriteFile writes the file to the workspace and returns its path.
+func (w *Workspace) WriteFile(name string, data []byte) (string, error) {
+  path := w.Path(name)
+  if err := os.WriteFile(path, data, 0600); err != nil {
+    return "", fmt.Errorf("error writing %s: %v", name, err)
+  }
+  return path, nil
+}
+
+// Mkdir creates a directory in the workspace, for the tools writing many
+// files.
+func (w *Workspace) Mkdir(name string) (string, error) {
+  path := w.Path(name)
+  if err := os.Mkdir(path, 0700); err != nil {
+    return "", fmt.Errorf("error creating %s: %v", name, err)
+  }
+  return path, nil
+}
+
+// Close removes the workspace. A failure is only logged, there is nothing
+// else to do about it.
+func (w *Workspace) Close() {
+  if err := os.RemoveAll(w.dir); err != nil {
+    l.Error().Err(err).Str("dir", w.dir).Msg("Failed to remove the workspace")
+  }
+}
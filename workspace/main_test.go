@@ -0,0 +1,55 @@
+package workspace_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/krol22/invoice_go_sort_sort/workspace"
+)
+
+func TestWorkspacesAreSeparateAndRemoved(t *testing.T) {
+  t.Setenv("TMPDIR", t.TempDir())
+
+  first, err := workspace.New()
+  if err != nil {
+    t.Fatalf("New: %v", err)
+  }
+  second, err := workspace.New()
+  if err != nil {
+    t.Fatalf("New: %v", err)
+  }
+  defer second.Close()
+
+  if first.Path("pdf.pdf") == second.Path("pdf.pdf") {
+    t.Fatal("two workspaces share the same path")
+  }
+
+  path, err := first.WriteFile("pdf.pdf", []byte("%PDF-1.4"))
+  if err != nil {
+    t.Fatalf("WriteFile: %v", err)
+  }
+  if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+    t.Errorf("file mode = %v, %v, want it private", info.Mode(), err)
+  }
+  if _, err := first.Mkdir("pages"); err != nil {
+    t.Fatalf("Mkdir: %v", err)
+  }
+
+  first.Close()
+  if _, err := os.Stat(first.Dir()); !os.IsNotExist(err) {
+    t.Errorf("workspace %s not removed: %v", first.Dir(), err)
+  }
+}
+
+func TestPathStaysInTheWorkspace(t *testing.T) {
+  ws, err := workspace.New()
+  if err != nil {
+    t.Fatalf("New: %v", err)
+  }
+  defer ws.Close()
+
+  if path := ws.Path("../../etc/passwd"); filepath.Dir(path) != ws.Dir() {
+    t.Errorf("path %s is outside of the workspace", path)
+  }
+}